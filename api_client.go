@@ -1,14 +1,21 @@
 package stadis
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 )
 
 //Default API client
@@ -17,7 +24,110 @@ var Cli = &ApiClient{ApiAddr: "localhost:8989"}
 var httpClient = &http.Client{Transport: &http.Transport{}}
 
 type ApiClient struct {
-	ApiAddr string
+	ApiAddr     string
+	Namespace   string //the namespace on the API server, empty for the default namespace.
+	watcherOnce sync.Once
+	connWatcher *connWatcher
+
+	//the clients returned by WithNamespace, keyed by the namespace.
+	nsMu      sync.Mutex
+	nsClients map[string]*ApiClient
+}
+
+//Get a copy of the client which works in the namespace, the same copy is returned for the same namespace,
+//so the connections of the namespace share one watch stream.
+func (client *ApiClient) WithNamespace(namespace string) *ApiClient {
+	client.nsMu.Lock()
+	defer client.nsMu.Unlock()
+	nsClient := client.nsClients[namespace]
+	if nsClient == nil {
+		if client.nsClients == nil {
+			client.nsClients = make(map[string]*ApiClient)
+		}
+		nsClient = &ApiClient{ApiAddr: client.ApiAddr, Namespace: namespace}
+		client.nsClients[namespace] = nsClient
+	}
+	return nsClient
+}
+
+//build the url of the API, the namespace is added to the query if set.
+func (client *ApiClient) url(format string, a ...interface{}) string {
+	u := "http://" + client.ApiAddr + fmt.Sprintf(format, a...)
+	if client.Namespace != "" {
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + "namespace=" + url.QueryEscape(client.Namespace)
+	}
+	return u
+}
+
+//Create a namespace with its own topology, ports and proxies, the config can be nil to use 'DefaultConfig'.
+func (client *ApiClient) CreateNamespace(name string, config io.Reader) (err error) {
+	if config == nil {
+		config = bytes.NewReader(nil)
+	}
+	url := fmt.Sprintf("http://%v/namespace?name=%v", client.ApiAddr, name)
+	resp, err := httpClient.Post(url, "application/json", config)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+//Delete a namespace, all its proxies will be stopped.
+func (client *ApiClient) DeleteNamespace(name string) (err error) {
+	url := fmt.Sprintf("http://%v/namespace?name=%v", client.ApiAddr, name)
+	req, _ := http.NewRequest("DELETE", url, nil)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+//Get the names of all the namespaces except the default one.
+func (client *ApiClient) Namespaces() (names []string, err error) {
+	url := fmt.Sprintf("http://%v/namespaces", client.ApiAddr)
+	err = client.getJSON(url, &names)
+	return
+}
+
+//Listen on the address, the listener is located at 'name' in the topology of the client's namespace.
+func (client *ApiClient) Listen(network, addr, name string) (net.Listener, error) {
+	return listen(client, network, addr, name)
+}
+
+func (client *ApiClient) NewListener(ol net.Listener, name string) (net.Listener, error) {
+	return newListener(client, ol, name)
+}
+
+func (client *ApiClient) ListenPacket(network, addr, name string) (net.PacketConn, error) {
+	return listenPacket(client, network, addr, name)
+}
+
+func (client *ApiClient) NewPacketConn(opc net.PacketConn, name string) (net.PacketConn, error) {
+	return newPacketConn(client, opc, name)
+}
+
+//Get a dialer dials servers as a client located at 'clientName' in the topology of the client's namespace.
+func (client *ApiClient) Dialer(clientName string, timeout time.Duration) *Dialer {
+	return &Dialer{ClientName: clientName, Timeout: timeout, Backend: client}
 }
 
 //Register the server port on API server.
@@ -33,7 +143,7 @@ func (client *ApiClient) ServerStopped(name, port string) error {
 }
 
 func (client *ApiClient) serverPort(method, name, port string) (err error) {
-	url := fmt.Sprintf("http://%v/serverPort?name=%v&port=%v", client.ApiAddr, name, port)
+	url := client.url("/serverPort?name=%v&port=%v", name, port)
 	req, _ := http.NewRequest(method, url, nil)
 	resp, err := httpClient.Do(req)
 	if err != nil {
@@ -56,6 +166,24 @@ func (client *ApiClient) ClientConnected(name, port string) error {
 	return client.clientPort("POST", name, port)
 }
 
+//register the client port of a connection with the server port it connects to,
+//so the connection is listed by 'Connections'.
+func (client *ApiClient) connectionOpened(name, clientPort, serverPort string) (err error) {
+	url := client.url("/clientPort?name=%v&port=%v&serverPort=%v", name, clientPort, serverPort)
+	resp, err := httpClient.Post(url, "application/json", nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
 //Unregister client port at API server.
 //Should be called after client closed a connection.
 func (client *ApiClient) ClientDisconnected(port string) error {
@@ -63,8 +191,7 @@ func (client *ApiClient) ClientDisconnected(port string) error {
 }
 
 func (client *ApiClient) clientPort(method, name, port string) (err error) {
-	url := fmt.Sprintf("http://%v/clientPort?name=%v&port=%v",
-		client.ApiAddr, name, port)
+	url := client.url("/clientPort?name=%v&port=%v", name, port)
 	req, _ := http.NewRequest(method, url, nil)
 	resp, err := httpClient.Do(req)
 	if err != nil {
@@ -81,28 +208,37 @@ func (client *ApiClient) clientPort(method, name, port string) (err error) {
 }
 
 //Get the dial state which can be used to simulate network latency or failure before actually dial the server.
-func (client *ApiClient) DialState(clientName, serverPort string) (state ConnState, err error) {
-	url := fmt.Sprintf("http://%v/dialState?clientName=%v&serverPort=%v", client.ApiAddr, clientName, serverPort)
+func (client *ApiClient) DialState(clientName, serverPort string) (state DialState, err error) {
+	return client.dialState(context.Background(), clientName, serverPort)
+}
+
+func (client *ApiClient) dialState(ctx context.Context, clientName, serverPort string) (state DialState, err error) {
+	url := client.url("/dialState?clientName=%v&serverPort=%v", clientName, serverPort)
+	err = client.getJSONContext(ctx, url, &state)
+	return
+}
+
+//Get the state of the datagrams sent from 'clientName' to 'serverPort'.
+func (client *ApiClient) PacketState(clientName, serverPort string) (state FlowState, err error) {
+	url := client.url("/packetState?clientName=%v&serverPort=%v", clientName, serverPort)
 	resp, err := httpClient.Get(url)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		err = errorFromResponse(resp)
-		log.Println(err)
+	if resp.StatusCode == 204 {
+		err = errPortNotRegistered
 		return
 	}
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
 		log.Println(err)
 		return
 	}
-	err = json.Unmarshal(data, &state)
+	err = json.NewDecoder(resp.Body).Decode(&state)
 	if err != nil {
 		log.Println(err)
-		return
 	}
 	return
 }
@@ -111,7 +247,7 @@ func (client *ApiClient) DialState(clientName, serverPort string) (state ConnSta
 //If 'oldState' is provided, this request will do long-polling, blocking for a few seconds
 //before get response if there is no new state updated.
 func (client *ApiClient) ConnState(clientPort, serverPort string, oldState *ConnState) (state *ConnState, err error) {
-	url := fmt.Sprintf("http://%v/connState?clientPort=%v&serverPort=%v", client.ApiAddr, clientPort, serverPort)
+	url := client.url("/connState?clientPort=%v&serverPort=%v", clientPort, serverPort)
 	req, _ := http.NewRequest("GET", url, nil)
 	if oldState != nil {
 		jsonBytes, _ := json.Marshal(oldState)
@@ -147,7 +283,7 @@ func (client *ApiClient) ConnState(clientPort, serverPort string, oldState *Conn
 
 //Get the node state by node name
 func (client *ApiClient) NodeState(name string) (nodeState NodeState, err error) {
-	url := fmt.Sprintf("http://%v/nodeState?name=%v", client.ApiAddr, name)
+	url := client.url("/nodeState?name=%v", name)
 	resp, err := httpClient.Get(url)
 	if err != nil {
 		log.Println(err)
@@ -175,7 +311,7 @@ func (client *ApiClient) NodeState(name string) (nodeState NodeState, err error)
 //Set the node's state, the name can be dc, rack or host depends on the number of dot in the name.
 //If latency of the nodeState is zero, the target node's latency will stay unchanged.
 func (client *ApiClient) UpdateNodeState(name string, nodeState NodeState) (err error) {
-	url := fmt.Sprintf("http://%v/nodeState?name=%v", client.ApiAddr, name)
+	url := client.url("/nodeState?name=%v", name)
 	jsonData, _ := json.Marshal(nodeState)
 	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(jsonData))
 	if err != nil {
@@ -191,10 +327,91 @@ func (client *ApiClient) UpdateNodeState(name string, nodeState NodeState) (err
 	return
 }
 
+//Add or update the link between two nodes, 'link.From' and 'link.To' are the node names of the two ends.
+func (client *ApiClient) UpdateLink(link Link) (err error) {
+	url := client.url("/link?from=%v&to=%v", link.From, link.To)
+	jsonData, _ := json.Marshal(link)
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(jsonData))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+//Remove the link between two nodes, the connection state between them will be computed from the hierarchy again.
+func (client *ApiClient) RemoveLink(from, to string) (err error) {
+	url := client.url("/link?from=%v&to=%v", from, to)
+	req, _ := http.NewRequest("DELETE", url, nil)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+//Get the link between two nodes.
+func (client *ApiClient) Link(from, to string) (link Link, err error) {
+	url := client.url("/link?from=%v&to=%v", from, to)
+	err = client.getJSON(url, &link)
+	return
+}
+
+//Get all the links in the topology.
+func (client *ApiClient) Links() (links []Link, err error) {
+	url := client.url("/links")
+	err = client.getJSON(url, &links)
+	return
+}
+
+func (client *ApiClient) getJSON(url string, v interface{}) (err error) {
+	return client.getJSONContext(context.Background(), url, v)
+}
+
+func (client *ApiClient) getJSONContext(ctx context.Context, url string, v interface{}) (err error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
 //Update the API server config, the topology on API server will be rebuild.
 //You can use the 'DefaultConfig' as a base config, then do some modification to meet your requirement.
+//The 'Proxies' in the config are started, the proxies already running on the same ports are restarted.
 func (client *ApiClient) UpdateConfig(reader io.Reader) (err error) {
-	url := fmt.Sprintf("http://%v/config", client.ApiAddr)
+	url := client.url("/config")
 	resp, err := httpClient.Post(url, "application/json", reader)
 	if err != nil {
 		log.Println(err)
@@ -209,6 +426,379 @@ func (client *ApiClient) UpdateConfig(reader io.Reader) (err error) {
 	return
 }
 
+//Update the API server config but keep the registered ports whose hosts still exist in the new config,
+//so the listeners and open connections keep working with the new states.
+func (client *ApiClient) MergeConfig(reader io.Reader) (err error) {
+	url := client.url("/config?merge=true")
+	resp, err := httpClient.Post(url, "application/json", reader)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+//Start the scenario in the API server and block until it finishes, the error of the failed step is returned.
+func (client *ApiClient) RunScenario(scenario *Scenario) (err error) {
+	err = client.StartScenario(scenario)
+	if err != nil {
+		return
+	}
+	for {
+		time.Sleep(100 * time.Millisecond)
+		var status ScenarioStatus
+		status, err = client.ScenarioStatus()
+		if err != nil {
+			return
+		}
+		if !status.Running {
+			if status.Err != "" {
+				err = errors.New(status.Err)
+			} else if status.Done < status.Total {
+				err = errors.New("scenario stopped")
+			}
+			return
+		}
+	}
+}
+
+//Start the scenario in the API server without waiting, only one scenario can run in a namespace at a time.
+func (client *ApiClient) StartScenario(scenario *Scenario) (err error) {
+	url := client.url("/scenario")
+	jsonData, _ := json.Marshal(scenario)
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(jsonData))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+//Stop the running scenario, the executed steps are not reverted.
+func (client *ApiClient) StopScenario() (err error) {
+	url := client.url("/scenario")
+	req, _ := http.NewRequest("DELETE", url, nil)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+func (client *ApiClient) ScenarioStatus() (status ScenarioStatus, err error) {
+	url := client.url("/scenario")
+	err = client.getJSON(url, &status)
+	return
+}
+
+//Start the nemesis in the API server, it applies random faults and heals them until it is stopped.
+func (client *ApiClient) StartNemesis(nemesis Nemesis) (err error) {
+	url := client.url("/nemesis")
+	jsonData, _ := json.Marshal(nemesis)
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(jsonData))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+//Stop the nemesis, it returns after the current fault is healed.
+func (client *ApiClient) StopNemesis() (err error) {
+	url := client.url("/nemesis")
+	req, _ := http.NewRequest("DELETE", url, nil)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+func (client *ApiClient) NemesisStatus() (status NemesisStatus, err error) {
+	url := client.url("/nemesis")
+	err = client.getJSON(url, &status)
+	return
+}
+
+//the bandwidth is taken on the API server, so the connections of all the processes share it.
+//The data is not throttled if the API server can't be reached, the connections fail by their states anyway.
+func (client *ApiClient) reserveUplinks(uplinks []Uplink, n int) (wait time.Duration) {
+	url := client.url("/reserve?bytes=%v", n)
+	jsonData, _ := json.Marshal(uplinks)
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(jsonData))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Println(errorFromResponse(resp))
+		return
+	}
+	var result reserveResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return result.Wait
+}
+
+func (client *ApiClient) watcher() *connWatcher {
+	client.watcherOnce.Do(func() {
+		client.connWatcher = newConnWatcher(client)
+	})
+	return client.connWatcher
+}
+
+//read the watch stream, the server writes a line when the topology is changed.
+func (client *ApiClient) watchChanges(ctx context.Context, changed func()) (err error) {
+	url := client.url("/watch")
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		return
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		changed()
+	}
+	err = scanner.Err()
+	if err == nil {
+		err = errors.New("watch stream closed")
+	}
+	return
+}
+
+//get the states of many connections in one request.
+func (client *ApiClient) connStates(ports []connPorts) (results []connStateResult, err error) {
+	url := client.url("/connStates")
+	jsonData, _ := json.Marshal(ports)
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(jsonData))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	return
+}
+
+//List the open connections created by stadis dialers and proxies.
+//If 'host' is not empty, only the connections from or to the host are listed,
+//if 'prefix' is not empty, only the connections from or to the hosts under the node are listed.
+func (client *ApiClient) Connections(host, prefix string) (conns []ConnInfo, err error) {
+	url := client.url("/connections?host=%v&prefix=%v", host, prefix)
+	err = client.getJSON(url, &conns)
+	return
+}
+
+//Kill the connection without any partition, the mode is 'KillReset' if empty.
+//The process owning the connection kills it on the next state update, its reads and writes fail
+//and the server gets a RST for 'KillReset' or a FIN for 'KillGraceful', proxied connections are killed the same way.
+func (client *ApiClient) KillConnection(clientPort, serverPort int, mode string) (err error) {
+	url := client.url("/connections?clientPort=%v&serverPort=%v&mode=%v", clientPort, serverPort, mode)
+	req, _ := http.NewRequest("DELETE", url, nil)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+//Get the stream of state changes from the API server until the context is done or the connection is broken,
+//the channel is closed then. Events are dropped if the receiver is too slow.
+func (client *ApiClient) Events(ctx context.Context) (events <-chan Event, err error) {
+	url := client.url("/events")
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		resp.Body.Close()
+		log.Println(err)
+		return
+	}
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var ev Event
+			err := json.Unmarshal([]byte(line[len("data: "):]), &ev)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	events = ch
+	return
+}
+
+//Get the live topology from the API server, including the node states changed at runtime, the registered server ports
+//and the running proxies.
+//It can be saved and loaded later by 'UpdateConfig'.
+func (client *ApiClient) Config() (config *Config, err error) {
+	url := client.url("/config")
+	config = new(Config)
+	err = client.getJSON(url, config)
+	return
+}
+
+//Insert a data center, rack or host into the live topology, e.g. "animal.land.cat", its parent must exist.
+//The default state of its level in the config is used if 'state' is nil.
+func (client *ApiClient) AddNode(name string, state *NodeState) (err error) {
+	url := client.url("/node?name=%v", name)
+	var body io.Reader = bytes.NewReader(nil)
+	if state != nil {
+		jsonData, _ := json.Marshal(state)
+		body = bytes.NewReader(jsonData)
+	}
+	resp, err := httpClient.Post(url, "application/json", body)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+//Delete a data center, rack or host and the links attached to it.
+//It fails if any host under the node has registered ports, unless 'force' is true,
+//then the ports are unregistered and the connections on them get errors.
+func (client *ApiClient) RemoveNode(name string, force bool) (err error) {
+	url := client.url("/node?name=%v&force=%v", name, force)
+	req, _ := http.NewRequest("DELETE", url, nil)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+//Save the states of all the nodes and links as a named snapshot, the registered ports are not included.
+func (client *ApiClient) Snapshot(name string) error {
+	return client.post(client.url("/snapshot?name=%v", name))
+}
+
+//Restore the node and link states from the snapshot, the open connections get the restored states.
+func (client *ApiClient) Restore(name string) error {
+	return client.post(client.url("/restore?name=%v", name))
+}
+
+func (client *ApiClient) DeleteSnapshot(name string) (err error) {
+	url := client.url("/snapshot?name=%v", name)
+	req, _ := http.NewRequest("DELETE", url, nil)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+//post without body.
+func (client *ApiClient) post(url string) (err error) {
+	resp, err := httpClient.Post(url, "application/json", nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = errorFromResponse(resp)
+		log.Println(err)
+		return
+	}
+	return
+}
+
+//Get the proxies running in API server process, sorted by proxy port.
+func (client *ApiClient) Proxies() (proxies []Proxy, err error) {
+	url := client.url("/proxies")
+	err = client.getJSON(url, &proxies)
+	return
+}
+
 //Start a proxy server in API server process.
 //The 'clientName' going to be used to register a client port at API server when the proxy server accepts a new connection,
 //For example, if you pass 'matter.metal.gold' as clientName, every client connected to the proxy server will be considered
@@ -230,8 +820,7 @@ func (client *ApiClient) StopProxy(proxyPort string) (err error) {
 }
 
 func (client *ApiClient) proxy(method, clientName, proxyName, proxyPort, originAddr string) (err error) {
-	url := fmt.Sprintf("http://%v/proxy?clientName=%s&proxyName=%s&proxyPort=%s&originAddr=%s",
-		client.ApiAddr, clientName, proxyName, proxyPort, originAddr)
+	url := client.url("/proxy?clientName=%s&proxyName=%s&proxyPort=%s&originAddr=%s", clientName, proxyName, proxyPort, originAddr)
 	req, _ := http.NewRequest(method, url, nil)
 	resp, err := httpClient.Do(req)
 	if err != nil {
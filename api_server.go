@@ -3,29 +3,143 @@ package stadis
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 //The API server holds the state of topology and proxy servers, serve requests from API client.
+//Each namespace has its own topology, ports and proxies, so tests running in parallel don't affect each other.
 type ApiServer struct {
-	mu      sync.RWMutex
-	topo    *topology
-	proxies map[string]*proxyServer
+	mu         sync.RWMutex
+	namespaces map[string]*namespace
+}
+
+type namespace struct {
+	mu       sync.RWMutex
+	network  *Network
+	proxies  map[string]*proxyServer
+	scenario scenarioRunner
+	nemesis  nemesisRunner
+}
+
+func newNamespace(network *Network) (ns *namespace) {
+	ns = new(namespace)
+	ns.proxies = make(map[string]*proxyServer)
+	ns.network = network
+	return
 }
 
 func NewApiServer() (ms *ApiServer) {
+	return NewNetworkApiServer(NewNetwork())
+}
+
+//Create an API server serves the REST API on top of the embedded network,
+//so processes can share the network with the process it is embedded in.
+//The network is the default namespace of the API server.
+func NewNetworkApiServer(network *Network) (ms *ApiServer) {
 	ms = new(ApiServer)
-	ms.proxies = make(map[string]*proxyServer)
-	ms.topo, _ = newTopology(bytes.NewReader(DefaultConfig))
+	ms.namespaces = make(map[string]*namespace)
+	ms.namespaces[""] = newNamespace(network)
+	return
+}
+
+func (s *ApiServer) getNamespace(name string) (ns *namespace) {
+	s.mu.RLock()
+	ns = s.namespaces[name]
+	s.mu.RUnlock()
 	return
 }
 
-func (s *ApiServer) connState(w http.ResponseWriter, r *http.Request) {
+//create a namespace with optional config in the body, or delete a namespace.
+func (s *ApiServer) namespace(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "'name' required", 400)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		ns := newNamespace(NewNetwork())
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if len(body) > 0 {
+			err = ns.updateConfig(body, false)
+			if err != nil {
+				ns.close()
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.namespaces[name] != nil {
+			ns.close()
+			errStr := "namespace exists already"
+			log.Println(errStr)
+			http.Error(w, errStr, 400)
+			return
+		}
+		s.namespaces[name] = ns
+	case "DELETE":
+		s.mu.Lock()
+		ns := s.namespaces[name]
+		delete(s.namespaces, name)
+		s.mu.Unlock()
+		if ns == nil {
+			errStr := "namespace not found"
+			log.Println(errStr)
+			http.Error(w, errStr, 404)
+			return
+		}
+		ns.close()
+	}
+}
+
+func (s *ApiServer) listNamespaces(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	names := []string{}
+	for name := range s.namespaces {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(names)
+	data, _ := json.Marshal(names)
+	w.Write(data)
+}
+
+//stop the scenario, the nemesis and all the proxies, wake up all the blocking requests, they will find the namespace is gone.
+func (ns *namespace) close() {
+	ns.stopScenario()
+	ns.stopNemesis()
+	ns.mu.Lock()
+	for port, ps := range ns.proxies {
+		if ps != nil {
+			ps.close()
+		}
+		delete(ns.proxies, port)
+	}
+	ns.mu.Unlock()
+	ns.network.close()
+}
+
+func (ns *namespace) topology() *topology {
+	return ns.network.topology()
+}
+
+func (ns *namespace) connState(w http.ResponseWriter, r *http.Request) {
 	clientPort := intFormValue(r, "clientPort")
 	if clientPort == 0 {
 		http.Error(w, "'clientPort' required", 400)
@@ -36,47 +150,53 @@ func (s *ApiServer) connState(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "'serverPort' required", 400)
 		return
 	}
-	s.mu.Lock()
-	topo := s.topo
-	s.mu.Unlock()
-	updateCh := topo.getUpdateChannel()
-	connState, err := topo.connState(clientPort, serverPort)
+	var oldState *ConnState
+	oldStateStr := r.Header.Get("If-None-Match")
+	if oldStateStr != "" {
+		oldState = new(ConnState)
+		err := json.Unmarshal([]byte(oldStateStr), oldState)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "invalid If-None-Match header", 400)
+			return
+		}
+	}
+	//long-poling if old state is provided.
+	connState, err := ns.network.ConnState(strconv.Itoa(clientPort), strconv.Itoa(serverPort), oldState)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), 400)
 		return
 	}
-	oldStateStr := r.Header.Get("If-None-Match")
-	if oldStateStr == "" {
+	if oldState != nil && oldState.equal(connState) {
+		w.WriteHeader(304)
+	} else {
 		connStateBytes, _ := json.Marshal(connState)
 		w.Write(connStateBytes)
-		return
 	}
+}
 
-	var oldState ConnState
-	err = json.Unmarshal([]byte(oldStateStr), &oldState)
-	if err != nil {
-		log.Println(err)
-		http.Error(w, "invalid If-None-Match header", 400)
+func (ns *namespace) dialState(w http.ResponseWriter, r *http.Request) {
+	clientName := r.FormValue("clientName")
+	if clientName == "" {
+		http.Error(w, "'clientName' required", 400)
 		return
 	}
-	if oldState == connState {
-		//long-poling
-		select {
-		case <-time.After(time.Second * 3):
-		case <-updateCh:
-			connState, _ = topo.connState(clientPort, serverPort)
-		}
+	serverPort := intFormValue(r, "serverPort")
+	if serverPort == 0 {
+		http.Error(w, "'serverPort' required", 400)
+		return
 	}
-	if oldState == connState {
-		w.WriteHeader(304)
-	} else {
-		connStateBytes, _ := json.Marshal(connState)
-		w.Write(connStateBytes)
+	dialState, err := ns.network.DialState(clientName, strconv.Itoa(serverPort))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
 	}
+	jsonBytes, _ := json.Marshal(dialState)
+	w.Write(jsonBytes)
 }
 
-func (s *ApiServer) dialState(w http.ResponseWriter, r *http.Request) {
+func (ns *namespace) packetState(w http.ResponseWriter, r *http.Request) {
 	clientName := r.FormValue("clientName")
 	if clientName == "" {
 		http.Error(w, "'clientName' required", 400)
@@ -87,16 +207,21 @@ func (s *ApiServer) dialState(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "'serverPort' required", 400)
 		return
 	}
-	connState, err := s.topo.dialState(clientName, serverPort)
+	packetState, err := ns.topology().packetState(clientName, serverPort)
+	if err == errPortNotRegistered {
+		//the datagrams to the port are not simulated.
+		w.WriteHeader(204)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
-	jsonBytes, _ := json.Marshal(connState)
+	jsonBytes, _ := json.Marshal(packetState)
 	w.Write(jsonBytes)
 }
 
-func (s *ApiServer) serverPort(w http.ResponseWriter, r *http.Request) {
+func (ns *namespace) serverPort(w http.ResponseWriter, r *http.Request) {
 	port := intFormValue(r, "port")
 	if port == 0 {
 		http.Error(w, "'port' required", 400)
@@ -110,16 +235,16 @@ func (s *ApiServer) serverPort(w http.ResponseWriter, r *http.Request) {
 	var err error
 	switch r.Method {
 	case "POST":
-		err = s.topo.addServerPort(name, port)
+		err = ns.topology().addServerPort(name, port)
 	case "DELETE":
-		err = s.topo.removeServerPort(name, port)
+		err = ns.topology().removeServerPort(name, port)
 	}
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 	}
 }
 
-func (s *ApiServer) clientPort(w http.ResponseWriter, r *http.Request) {
+func (ns *namespace) clientPort(w http.ResponseWriter, r *http.Request) {
 	port := intFormValue(r, "port")
 	if port == 0 {
 		http.Error(w, "'port' required", 400)
@@ -133,18 +258,23 @@ func (s *ApiServer) clientPort(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "'name' required", 400)
 			return
 		}
-		err = s.topo.addClientPort(name, port)
+		serverPort := intFormValue(r, "serverPort")
+		if serverPort != 0 {
+			err = ns.topology().openConn(name, port, serverPort)
+		} else {
+			err = ns.topology().addClientPort(name, port)
+		}
 	case "DELETE":
-		err = s.topo.removeClientPort(port)
+		err = ns.topology().removeClientPort(port)
 	}
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 	}
 }
 
-func (s *ApiServer) nodeState(w http.ResponseWriter, r *http.Request) {
+func (ns *namespace) nodeState(w http.ResponseWriter, r *http.Request) {
 	name := r.FormValue("name")
-	nodeState, err := s.topo.nodeState(name)
+	nodeState, err := ns.topology().nodeState(name)
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
@@ -160,41 +290,364 @@ func (s *ApiServer) nodeState(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 400)
 			return
 		}
-		s.topo.setNodeState(name, newState)
+		err = ns.topology().setNodeState(name, newState)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+	}
+}
+
+//insert a node with optional json body of its state, or delete a node.
+func (ns *namespace) node(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	switch r.Method {
+	case "POST":
+		var state *NodeState
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if len(body) > 0 {
+			state = new(NodeState)
+			err = json.Unmarshal(body, state)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		err = ns.topology().addNode(name, state)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	case "DELETE":
+		err := ns.topology().removeNode(name, r.FormValue("force") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func (ns *namespace) link(w http.ResponseWriter, r *http.Request) {
+	from := r.FormValue("from")
+	if from == "" {
+		http.Error(w, "'from' required", 400)
+		return
+	}
+	to := r.FormValue("to")
+	if to == "" {
+		http.Error(w, "'to' required", 400)
+		return
+	}
+	var err error
+	switch r.Method {
+	case "GET":
+		var link Link
+		link, err = ns.topology().link(from, to)
+		if err == nil {
+			data, _ := json.Marshal(link)
+			w.Write(data)
+		}
+	case "POST":
+		var link Link
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&link)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		link.From = from
+		link.To = to
+		err = ns.topology().setLink(link)
+	case "DELETE":
+		err = ns.topology().removeLink(from, to)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+	}
+}
+
+func (ns *namespace) links(w http.ResponseWriter, r *http.Request) {
+	links := ns.topology().allLinks()
+	if links == nil {
+		links = []Link{}
 	}
+	data, _ := json.Marshal(links)
+	w.Write(data)
 }
 
-func (s *ApiServer) postConfig(w http.ResponseWriter, r *http.Request) {
-	topo, err := newTopology(r.Body)
+//save the node and link states as a named snapshot, or delete the snapshot.
+func (ns *namespace) snapshot(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	var err error
+	switch r.Method {
+	case "POST":
+		err = ns.topology().saveSnapshot(name)
+	case "DELETE":
+		err = ns.topology().deleteSnapshot(name)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
-	s.mu.Lock()
-	if s.topo != nil {
-		close(s.topo.getUpdateChannel())
+}
+
+func (ns *namespace) restore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	err := ns.topology().restoreSnapshot(r.FormValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
 	}
-	s.topo = topo
-	s.mu.Unlock()
 }
 
-func (s *ApiServer) proxy(w http.ResponseWriter, r *http.Request) {
+//start a scenario with json body, stop the running scenario, or get the status.
+func (ns *namespace) scenarioHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		scenario := new(Scenario)
+		err := json.NewDecoder(r.Body).Decode(scenario)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		err = ns.startScenario(scenario)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	case "DELETE":
+		ns.stopScenario()
+	default:
+		data, _ := json.Marshal(ns.scenarioStatus())
+		w.Write(data)
+	}
+}
+
+//start the nemesis with json body, stop it after the current fault is healed, or get the actions it took.
+func (ns *namespace) nemesisHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var nemesis Nemesis
+		err := json.NewDecoder(r.Body).Decode(&nemesis)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		err = ns.startNemesis(nemesis)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	case "DELETE":
+		ns.stopNemesis()
+	default:
+		data, _ := json.Marshal(ns.nemesisStatus())
+		w.Write(data)
+	}
+}
+
+//stream a line with the version of the topology when it is changed, the first line is written at once.
+//A client process keeps one watch stream for all its connections, and gets their states by '/connStates'.
+func (ns *namespace) watch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(200)
+	atomic.AddInt64(&ns.network.metrics.watchStreams, 1)
+	defer atomic.AddInt64(&ns.network.metrics.watchStreams, -1)
+	version := 0
+	ns.network.watchChanges(r.Context(), func() {
+		version++
+		fmt.Fprintln(w, version)
+		flusher.Flush()
+	})
+}
+
+//get the states of the connections in the json body like '[{"ClientPort":"1234","ServerPort":"5678"}]'.
+func (ns *namespace) connStates(w http.ResponseWriter, r *http.Request) {
+	var ports []connPorts
+	err := json.NewDecoder(r.Body).Decode(&ports)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	results, _ := ns.network.connStates(ports)
+	data, _ := json.Marshal(results)
+	w.Write(data)
+}
+
+//take 'bytes' from the uplinks in the json body like '[{"Name":"animal.land/out","Bandwidth":102400}]'.
+func (ns *namespace) reserve(w http.ResponseWriter, r *http.Request) {
+	n := intFormValue(r, "bytes")
+	if n <= 0 {
+		http.Error(w, "'bytes' required", 400)
+		return
+	}
+	var uplinks []Uplink
+	err := json.NewDecoder(r.Body).Decode(&uplinks)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	for _, uplink := range uplinks {
+		if uplink.Bandwidth <= 0 {
+			http.Error(w, "bandwidth of uplink "+uplink.Name+" should be positive", 400)
+			return
+		}
+	}
+	data, _ := json.Marshal(reserveResult{Wait: ns.network.reserveUplinks(uplinks, n)})
+	w.Write(data)
+}
+
+//list the open connections, filtered by 'host' and 'prefix' if provided, or kill a connection.
+func (ns *namespace) connections(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		clientPort := intFormValue(r, "clientPort")
+		serverPort := intFormValue(r, "serverPort")
+		if clientPort == 0 || serverPort == 0 {
+			http.Error(w, "'clientPort' and 'serverPort' required", 400)
+			return
+		}
+		err := ns.topology().killConn(clientPort, serverPort, r.FormValue("mode"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+		return
+	}
+	conns := ns.topology().connections(r.FormValue("host"), r.FormValue("prefix"))
+	data, _ := json.Marshal(conns)
+	w.Write(data)
+}
+
+//stream the events as Server-Sent Events until the client disconnects.
+func (ns *namespace) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", 500)
+		return
+	}
+	events, _ := ns.network.Events(r.Context())
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+	for ev := range events {
+		data, _ := json.Marshal(ev)
+		_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (ns *namespace) getConfig(w http.ResponseWriter, r *http.Request) {
+	data, _ := json.Marshal(ns.config())
+	w.Write(data)
+}
+
+//the live topology with the running proxies, the ports of the proxies are not listed in the hosts,
+//they are registered again when the proxies are started by loading the config.
+func (ns *namespace) config() (config *Config) {
+	config = ns.topology().config()
+	proxyPorts := make(map[int]bool)
+	for _, ps := range ns.sortedProxies() {
+		config.Proxies = append(config.Proxies, ps.info())
+		port, _ := strconv.Atoi(ps.proxyPort)
+		proxyPorts[port] = true
+	}
+	for _, dc := range config.DataCenters {
+		for _, rack := range dc.Racks {
+			for _, host := range rack.Hosts {
+				ports := []int{}
+				for _, port := range host.Ports {
+					if !proxyPorts[port] {
+						ports = append(ports, port)
+					}
+				}
+				host.Ports = ports
+			}
+		}
+	}
+	return
+}
+
+//with 'merge' set to true, the registered ports are kept.
+func (ns *namespace) postConfig(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	err = ns.updateConfig(body, r.FormValue("merge") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+}
+
+//rebuild the topology with the config, then start the proxies in it,
+//the proxies already running on the same ports are restarted with the new definitions.
+func (ns *namespace) updateConfig(data []byte, merge bool) (err error) {
+	config := new(Config)
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if merge {
+		err = ns.network.MergeConfig(bytes.NewReader(data))
+	} else {
+		err = ns.network.UpdateConfig(bytes.NewReader(data))
+	}
+	if err != nil {
+		return
+	}
+	for _, p := range config.Proxies {
+		if ns.getProxy(p.ProxyPort) != nil {
+			ns.stopProxy(p.ProxyPort)
+		}
+		err = ns.startProxy(p.ClientName, p.ProxyName, p.ProxyPort, p.OriginAddr)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+//Load the config into the default namespace, the topology is rebuilt and the proxies in the config are started,
+//the same as 'ApiClient.UpdateConfig'.
+func (s *ApiServer) LoadConfig(reader io.Reader) (err error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return s.getNamespace("").updateConfig(data, false)
+}
+
+func (ns *namespace) proxy(w http.ResponseWriter, r *http.Request) {
 
 	proxyPort := r.FormValue("proxyPort")
 	if proxyPort == "" {
 		http.Error(w, "'proxyPort' required", 400)
 		return
 	}
-	ps := s.getProxy(proxyPort)
+	ps := ns.getProxy(proxyPort)
 	var err error
 	switch r.Method {
 	case "POST":
-		if ps != nil {
-			errStr := "proxy port is taken"
-			log.Println(errStr)
-			http.Error(w, errStr, 400)
-			return
-		}
 		proxyName := r.FormValue("proxyName")
 		if proxyName == "" {
 			http.Error(w, "'proxyName' required", 400)
@@ -210,14 +663,11 @@ func (s *ApiServer) proxy(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "'clientName' required", 400)
 			return
 		}
-		ps, err = newProxyServer(clientName, proxyName, proxyPort, originAddr)
+		err = ns.startProxy(clientName, proxyName, proxyPort, originAddr)
 		if err != nil {
-			log.Println(err)
 			http.Error(w, err.Error(), 400)
 			return
 		}
-		go ps.serve()
-		s.setProxy(proxyPort, ps)
 	case "PUT":
 		if ps == nil {
 			errStr := "proxy server not found"
@@ -230,7 +680,8 @@ func (s *ApiServer) proxy(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "'clientName' required", 400)
 			return
 		}
-		ps.clientName = clientName
+		ps.setClientName(clientName)
+		ns.network.events.publish(Event{Type: EventProxyUpdated, Proxy: ps.info()})
 	case "DELETE":
 		if ps == nil {
 			errStr := "proxy server not found"
@@ -238,37 +689,76 @@ func (s *ApiServer) proxy(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, errStr, 404)
 			return
 		}
-		err = ps.close()
+		err = ns.stopProxy(proxyPort)
 		if err != nil {
 			log.Println(err)
 			return
 		}
-		s.setProxy(proxyPort, nil)
 	}
 }
 
-func (s *ApiServer) getProxy(port string) (ps *proxyServer) {
-	s.mu.RLock()
-	ps = s.proxies[port]
-	s.mu.RUnlock()
+func (ns *namespace) listProxies(w http.ResponseWriter, r *http.Request) {
+	proxies := []*Proxy{}
+	for _, ps := range ns.sortedProxies() {
+		proxies = append(proxies, ps.info())
+	}
+	data, _ := json.Marshal(proxies)
+	w.Write(data)
+}
+
+//start a proxy server in the namespace, used by the REST API and scenarios.
+func (ns *namespace) startProxy(clientName, proxyName, proxyPort, originAddr string) (err error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.proxies[proxyPort] != nil {
+		err = errors.New("proxy port is taken")
+		log.Println(err)
+		return
+	}
+	ps, err := newProxyServer(ns.network, clientName, proxyName, proxyPort, originAddr)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	go ps.serve()
+	ns.proxies[proxyPort] = ps
+	ns.network.events.publish(Event{Type: EventProxyStarted, Proxy: ps.info()})
 	return
 }
 
-func (s *ApiServer) setProxy(port string, ps *proxyServer) {
-	s.mu.Lock()
-	s.proxies[port] = ps
-	s.mu.Unlock()
+func (ns *namespace) stopProxy(proxyPort string) (err error) {
+	ns.mu.Lock()
+	ps := ns.proxies[proxyPort]
+	delete(ns.proxies, proxyPort)
+	ns.mu.Unlock()
+	if ps == nil {
+		err = errors.New("proxy server not found")
+		log.Println(err)
+		return
+	}
+	err = ps.close()
+	ns.network.events.publish(Event{Type: EventProxyStopped, Proxy: ps.info()})
+	return
 }
 
+func (ns *namespace) getProxy(port string) (ps *proxyServer) {
+	ns.mu.RLock()
+	ps = ns.proxies[port]
+	ns.mu.RUnlock()
+	return
+}
+
+
 //dump the node state, if 'name' is empty, the whole topology will be dumped.
 func (s *ApiServer) DumpNode(name string) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	topo := s.getNamespace("").topology()
+	topo.mutex.RLock()
+	defer topo.mutex.RUnlock()
 	if name == "" {
-		fmt.Println(s.topo)
+		fmt.Println(topo)
 		return
 	}
-	node, err := s.topo.lookup(name)
+	node, err := topo.lookup(name)
 	if err != nil {
 		log.Println(err)
 		return
@@ -277,30 +767,77 @@ func (s *ApiServer) DumpNode(name string) {
 }
 
 func (s *ApiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path == "/config" && r.Method == "POST" {
-		s.postConfig(w, r)
+	switch r.URL.Path {
+	case "/namespace":
+		s.namespace(w, r)
+		return
+	case "/namespaces":
+		s.listNamespaces(w, r)
+		return
+	case "/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+		return
+	}
+	ns := s.getNamespace(r.FormValue("namespace"))
+	if ns == nil {
+		http.Error(w, "namespace not found", 404)
+		return
+	}
+	if r.URL.Path == "/ui" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
 		return
 	}
-	s.mu.Lock()
-	topo := s.topo
-	s.mu.Unlock()
-	if topo == nil {
-		http.Error(w, "server uninitialized.", 400)
+	if r.URL.Path == "/config" {
+		if r.Method == "POST" {
+			ns.postConfig(w, r)
+		} else {
+			ns.getConfig(w, r)
+		}
 		return
 	}
 	switch r.URL.Path {
 	case "/connState":
-		s.connState(w, r)
+		ns.connState(w, r)
 	case "/nodeState":
-		s.nodeState(w, r)
+		ns.nodeState(w, r)
+	case "/node":
+		ns.node(w, r)
 	case "/serverPort":
-		s.serverPort(w, r)
+		ns.serverPort(w, r)
 	case "/clientPort":
-		s.clientPort(w, r)
+		ns.clientPort(w, r)
 	case "/dialState":
-		s.dialState(w, r)
+		ns.dialState(w, r)
+	case "/packetState":
+		ns.packetState(w, r)
+	case "/link":
+		ns.link(w, r)
+	case "/links":
+		ns.links(w, r)
 	case "/proxy":
-		s.proxy(w, r)
+		ns.proxy(w, r)
+	case "/proxies":
+		ns.listProxies(w, r)
+	case "/scenario":
+		ns.scenarioHandler(w, r)
+	case "/nemesis":
+		ns.nemesisHandler(w, r)
+	case "/watch":
+		ns.watch(w, r)
+	case "/connStates":
+		ns.connStates(w, r)
+	case "/reserve":
+		ns.reserve(w, r)
+	case "/events":
+		ns.events(w, r)
+	case "/connections":
+		ns.connections(w, r)
+	case "/snapshot":
+		ns.snapshot(w, r)
+	case "/restore":
+		ns.restore(w, r)
 	default:
 		w.WriteHeader(404)
 	}
@@ -0,0 +1,95 @@
+package stadis
+
+import (
+	"sync"
+	"time"
+)
+
+//token buckets of a network keyed by the name of the uplink, shared by all the connections of the network,
+//the connections of the API clients take the bandwidth through the API server, so they share it across processes.
+type bucketSet struct {
+	sync.Mutex
+	m map[string]*tokenBucket
+}
+
+func newBucketSet() *bucketSet {
+	return &bucketSet{m: make(map[string]*tokenBucket)}
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   int64 //bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func (buckets *bucketSet) get(uplink string, rate int64) (tb *tokenBucket) {
+	buckets.Lock()
+	tb = buckets.m[uplink]
+	if tb == nil {
+		tb = &tokenBucket{rate: rate, tokens: float64(burstSize(rate)), last: time.Now()}
+		buckets.m[uplink] = tb
+	}
+	buckets.Unlock()
+	return
+}
+
+//allow a burst of a few milliseconds of data, but at least one packet.
+func burstSize(rate int64) int64 {
+	burst := rate / 100
+	if burst < packetSize {
+		burst = packetSize
+	}
+	return burst
+}
+
+//take n bytes from the bucket, return the time to wait before the bytes can be sent.
+//The tokens are taken even if the caller gives up waiting, like the bytes already queued on the uplink.
+func (tb *tokenBucket) reserve(n int, rate int64) (wait time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := time.Now()
+	tb.rate = rate
+	tb.tokens += now.Sub(tb.last).Seconds() * float64(rate)
+	if burst := float64(burstSize(rate)); tb.tokens > burst {
+		tb.tokens = burst
+	}
+	tb.last = now
+	tb.tokens -= float64(n)
+	if tb.tokens < 0 {
+		wait = time.Duration(-tb.tokens / float64(rate) * float64(time.Second))
+	}
+	return
+}
+
+//the response of '/reserve'.
+type reserveResult struct {
+	Wait time.Duration
+}
+
+//take n bytes from the buckets of all the uplinks, the data waits for the slowest one.
+func (buckets *bucketSet) reserve(uplinks []Uplink, n int) (wait time.Duration) {
+	for _, uplink := range uplinks {
+		if w := buckets.get(uplink.Name, uplink.Bandwidth).reserve(n, uplink.Bandwidth); w > wait {
+			wait = w
+		}
+	}
+	return
+}
+
+//wait until n bytes can go through all the limited uplinks of the flow, return false if closed before that.
+func throttle(backend Backend, state FlowState, n int, closeCh chan struct{}) bool {
+	if len(state.Uplinks) == 0 {
+		return true
+	}
+	wait := backend.reserveUplinks(state.Uplinks, n)
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(wait):
+		return true
+	case <-closeCh:
+		return false
+	}
+}
@@ -1,6 +1,9 @@
 package stadis
 
-import "time"
+import (
+	"reflect"
+	"time"
+)
 
 var DefaultConfig = []byte(`
 {
@@ -63,15 +66,70 @@ var DefaultConfig = []byte(`
 }
 `)
 
+//The state of the data flowing in one direction of a connection.
+type FlowState struct {
+	Latency      time.Duration //the sleep time before the data is delivered.
+	OK           bool          //If not ok, the data should not be delivered.
+	Jitter       time.Duration //the random variation added to the latency of each packet.
+	Distribution string        //the distribution of the jitter.
+	LossRate     float64       //the probability of a packet to be lost.
+	DupRate      float64       //the probability of a datagram to be duplicated, only for packet connections.
+	Uplinks      []Uplink      `json:",omitempty"` //all the uplinks with limited bandwidth along the path.
+}
+
+//An uplink with limited bandwidth, the connections going through it share the bandwidth.
+type Uplink struct {
+	Name      string
+	Bandwidth int64
+}
+
+//The uplink with the lowest bandwidth along the path, the zero value if the bandwidth is unlimited.
+func (state FlowState) Bottleneck() (bottleneck Uplink) {
+	for _, uplink := range state.Uplinks {
+		if bottleneck.Bandwidth == 0 || uplink.Bandwidth < bottleneck.Bandwidth {
+			bottleneck = uplink
+		}
+	}
+	return
+}
+
+//The state of a connection seen from the client side.
 type ConnState struct {
-	Latency time.Duration //the sleep time before write data to the connection.
-	OK      bool          //If not ok, local process should not write data to the connection.
+	Send FlowState //from client to server, applied when writing data to the connection.
+	Recv FlowState //from server to client, applied when reading data from the connection.
+}
+
+func (cs *ConnState) equal(other *ConnState) bool {
+	return reflect.DeepEqual(cs, other)
+}
+
+type DialState struct {
+	Latency      time.Duration //the sleep time before dial the server, it is the round trip time.
+	OK           bool          //If not ok, local process should not dial the server.
+	Jitter       time.Duration `json:",omitempty"`
+	Distribution string        `json:",omitempty"`
+	LossRate     float64       `json:",omitempty"` //the probability of losing the SYN or SYN-ACK packet.
 }
 
+//If Jitter is not zero, the latency of each packet going through the node varies randomly,
+//Distribution can be "uniform"(default), "normal" or "pareto".
+//For "uniform" the latency is between Latency-Jitter and Latency+Jitter,
+//for "normal" the Jitter is the standard deviation,
+//for "pareto" the latency is never less than Latency, the Jitter is the mean of the extra delay with a long tail.
+//Bandwidth is the bytes per second of the node's uplink in each direction, zero means unlimited,
+//it is shared by all the connections going through the uplink.
+//LossRate is the probability of a packet to be lost when going through the node,
+//a lost packet on a tcp connection is retransmitted after a timeout, so it shows up as an extra delay.
+//DupRate is the probability of a datagram to be duplicated when going through the node, tcp connections are not affected.
 type NodeState struct {
 	Latency      time.Duration
 	InternalDown bool
 	ExternalDown bool
+	Jitter       time.Duration
+	Distribution string
+	Bandwidth    int64
+	LossRate     float64
+	DupRate      float64
 }
 
 type Config struct {
@@ -79,6 +137,8 @@ type Config struct {
 	RackDefault *NodeState
 	HostDefault *NodeState
 	DataCenters []*DataCenter
+	Links       []*Link
+	Proxies     []*Proxy `json:",omitempty"` //started by the API server when the config is loaded.
 }
 
 type DataCenter struct {
@@ -101,3 +161,30 @@ type Host struct {
 	Ports []int
 	*NodeState
 }
+
+//Link overrides the latency and failure computed from the hierarchy between two nodes.
+//For a connection between a host under 'From' and a host under 'To', only the nodes below
+//the two end nodes are computed as usual, the rest of the path is replaced by the link.
+//If more than one link matches a connection, the most specific one is used.
+//A one way link only applies to the data flowing from 'From' to 'To', the other direction is computed as usual,
+//so a one way link with 'Down' set makes an asymmetric partition.
+type Link struct {
+	From         string //node name of one end, e.g. "animal.air".
+	To           string //node name of the other end, e.g. "matter.metal".
+	Latency      time.Duration
+	Down         bool
+	OneWay       bool
+	Jitter       time.Duration
+	Distribution string
+	Bandwidth    int64
+	LossRate     float64
+	DupRate      float64
+}
+
+//Proxy describes a proxy server started in the API server process, see 'ApiClient.StartProxy'.
+type Proxy struct {
+	ClientName string
+	ProxyName  string
+	ProxyPort  string
+	OriginAddr string
+}
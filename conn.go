@@ -2,11 +2,16 @@ package stadis
 
 import (
 	"bytes"
-	"errors"
+	"context"
+	"io"
 	"log"
+	"math/rand"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -17,6 +22,9 @@ var	NumOfPackets = 128
 const packetSize   = 4 * 1024
 
 type connection struct {
+	sentBytes     int64 //accessed atomically, bytes written to the server.
+	recvBytes     int64 //accessed atomically, bytes received from the server.
+	backend       Backend
 	conn          net.Conn
 	connState     *ConnState
 	readDeadline  time.Time
@@ -25,21 +33,27 @@ type connection struct {
 	writePacketCh chan *packet
 	readPacketCh  chan *packet
 	readBuffer    bytes.Buffer //handle the case when packet length is longer than read buf length
+	pendingPacket *packet      //the packet not delivered yet when read deadline exceeded
 	readErr       error
 	writeErrCh    chan error
 	pool          packetPool
 	closeCh       chan struct{}
 	updateCh      chan struct{}
-	updateErrCh   chan error
-	oldState      *ConnState
+	failCh        chan struct{} //closed when the state can't be fetched or the connection is killed.
+	failErr       error
+	killMode      string
 	clientPort    string
 	serverPort    string
+	sendRand      *rand.Rand
+	recvRand      *rand.Rand
+	ownClientPort bool //the client port is registered by the dialer, so it is unregistered on close.
 }
 
 type packet struct {
 	data     []byte
 	length   int
 	sentTime int64
+	delay    time.Duration //the random delay added to the latency
 	err      error
 }
 
@@ -62,39 +76,86 @@ func (pp packetPool) put(p *packet) {
 	}
 }
 
-func (c *connection) updateLoop() {
-	for {
-		select {
-		case <-c.closeCh:
-			return
-		default:
-			oldState := c.getState()
-			newState, err := Cli.ConnState(c.clientPort, c.serverPort, oldState)
-			if err != nil {
-				log.Println(err)
-				c.updateErrCh <- err
-				return
-			}
-			if newState == oldState {
-				continue
-			}
-			c.mutex.Lock()
-			close(c.updateCh)
-			c.updateCh = make(chan struct{})
-			c.connState = newState
-			c.mutex.Unlock()
-		}
+//called by the watcher when the topology is changed, the loops waiting on 'updateCh' get the new state.
+func (c *connection) setState(newState *ConnState) {
+	if newState == nil {
+		return
+	}
+	c.mutex.Lock()
+	if c.connState == nil || !c.connState.equal(newState) {
+		close(c.updateCh)
+		c.updateCh = make(chan struct{})
+		c.connState = newState
+	}
+	c.mutex.Unlock()
+}
+
+//called by the watcher when the state can't be fetched, the following reads and writes return the error.
+func (c *connection) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.failErr != nil || c.killMode != "" {
+		return
+	}
+	c.failErr = err
+	close(c.failCh)
+}
 
+//called by the watcher when the connection is killed through the API,
+//with 'KillReset' the peer gets a RST and the following reads and writes return ECONNRESET,
+//with 'KillGraceful' the peer gets a FIN, reads return io.EOF and writes return EPIPE.
+func (c *connection) kill(mode string) {
+	c.mutex.Lock()
+	if c.failErr != nil || c.killMode != "" {
+		c.mutex.Unlock()
+		return
 	}
+	c.killMode = mode
+	close(c.failCh)
+	c.mutex.Unlock()
+	if tcpConn, ok := c.conn.(*net.TCPConn); ok && mode == KillReset {
+		tcpConn.SetLinger(0)
+	}
+	c.conn.Close()
+}
+
+//the error returned by read or write after the connection failed, nil if it hasn't.
+func (c *connection) failError(op string) (err error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	switch c.killMode {
+	case KillReset:
+		return c.opError(op, os.NewSyscallError(op, syscall.ECONNRESET))
+	case KillGraceful:
+		if op == "read" {
+			return io.EOF
+		}
+		return c.opError(op, os.NewSyscallError(op, syscall.EPIPE))
+	}
+	return c.failErr
+}
+
+//the kill mode if the connection is killed through the API, the proxy kills the downstream connection the same way.
+func (c *connection) killed() (mode string) {
+	c.mutex.RLock()
+	mode = c.killMode
+	c.mutex.RUnlock()
+	return
 }
 
 func (c *connection) readLoop() {
 	for {
 		packet := c.pool.get()
 		n, err := c.conn.Read(packet.data)
+		atomic.AddInt64(&c.recvBytes, int64(n))
+		state := c.getState().Recv
+		if !throttle(c.backend, state, n, c.closeCh) {
+			return
+		}
 		packet.err = err
 		packet.length = n
 		packet.sentTime = time.Now().UnixNano()
+		packet.delay = c.randomDelay(c.recvRand, state)
 		select {
 		case <-c.closeCh:
 			return
@@ -103,35 +164,54 @@ func (c *connection) readLoop() {
 	}
 }
 
-func (c *connection) readPacket(packet *packet, b []byte) (n int, err error) {
+func (c *connection) readPacket(packet *packet, b []byte, deadlineTimer <-chan time.Time) (n int, err error) {
 	for {
 		now := time.Now().UnixNano()
 		elapsed := now - packet.sentTime
-		state := c.getState()
-		remainedDelay := state.Latency - time.Duration(elapsed)
+		state := c.getState().Recv
+		remainedDelay := state.Latency + packet.delay - time.Duration(elapsed)
 		select {
 		case <-c.closeCh:
-			err = errors.New("connection closed")
+			err = c.opError("read", net.ErrClosed)
 			return
 		case <-time.After(remainedDelay):
+			if !state.OK {
+				err = c.opError("read", os.NewSyscallError("read", syscall.ETIMEDOUT))
+				return
+			}
+			recvDelays.observe(state.Latency + packet.delay)
 			n = copy(b, packet.data[:packet.length])
 			if packet.length <= len(b) {
 				err = packet.err
 				return
 			} else {
 				c.mutex.Lock()
-				c.readBuffer.Write(packet.data[packet.length:])
+				c.readBuffer.Write(packet.data[n:packet.length])
 				c.readErr = packet.err
 				c.mutex.Unlock()
 			}
 			c.pool.put(packet)
 			return
+		case <-deadlineTimer:
+			//the packet has not been delivered yet, keep it for the next read.
+			c.mutex.Lock()
+			c.pendingPacket = packet
+			c.mutex.Unlock()
+			err = c.opError("read", os.ErrDeadlineExceeded)
+			return
 		case <-c.updateCh:
 		}
 	}
 }
 
 func (mc *connection) Read(b []byte) (n int, err error) {
+	if mc.closed() {
+		err = mc.opError("read", net.ErrClosed)
+		return
+	}
+	if err = mc.failError("read"); err != nil {
+		return
+	}
 	mc.mutex.Lock()
 	n, _ = mc.readBuffer.Read(b)
 	if n == 0 {
@@ -147,18 +227,34 @@ func (mc *connection) Read(b []byte) (n int, err error) {
 	var deadlineTimer <-chan time.Time
 	mc.mutex.Lock()
 	if !mc.readDeadline.IsZero() {
+		if !time.Now().Before(mc.readDeadline) {
+			mc.mutex.Unlock()
+			err = mc.opError("read", os.ErrDeadlineExceeded)
+			return
+		}
 		deadlineTimer = time.After(mc.readDeadline.Sub(time.Now()))
 	}
+	pendingPacket := mc.pendingPacket
+	mc.pendingPacket = nil
 	mc.mutex.Unlock()
+	if pendingPacket != nil {
+		return mc.readPacket(pendingPacket, b, deadlineTimer)
+	}
 	select {
 	case packet := <-mc.readPacketCh:
-		n, err = mc.readPacket(packet, b)
-	case err = <-mc.updateErrCh:
-		log.Println(err)
+		n, err = mc.readPacket(packet, b, deadlineTimer)
+	case <-mc.failCh:
+		err = mc.failError("read")
 	case <-mc.closeCh:
-		err = errors.New("connection closed")
+		err = mc.opError("read", net.ErrClosed)
 	case <-deadlineTimer:
-		err = errors.New("read timeout")
+		err = mc.opError("read", os.ErrDeadlineExceeded)
+	}
+	if err != nil && !mc.closed() {
+		//the packet read before killed carries the error of the closed underlying connection.
+		if failErr := mc.failError("read"); failErr != nil {
+			err = failErr
+		}
 	}
 	return
 }
@@ -174,10 +270,13 @@ func (c *connection) writeLoop() {
 	}
 }
 func (c *connection) writePacket(packet *packet) {
+	state := c.getState().Send
+	packet.delay = c.randomDelay(c.sendRand, state)
 	for {
 		now := time.Now().UnixNano()
 		elapsed := now - packet.sentTime
-		remainedLatency := c.connState.Latency - time.Duration(elapsed)
+		state = c.getState().Send
+		remainedLatency := state.Latency + packet.delay - time.Duration(elapsed)
 		select {
 		case <-c.closeCh:
 			return
@@ -187,11 +286,17 @@ func (c *connection) writePacket(packet *packet) {
 			continue
 		case <-time.After(remainedLatency):
 		}
+		if !throttle(c.backend, state, packet.length, c.closeCh) {
+			return
+		}
 		var err error
-		if c.connState.OK {
-			_, err = c.conn.Write(packet.data[:packet.length])
+		if state.OK {
+			sendDelays.observe(state.Latency + packet.delay)
+			var n int
+			n, err = c.conn.Write(packet.data[:packet.length])
+			atomic.AddInt64(&c.sentBytes, int64(n))
 		} else {
-			err = errors.New("connection error")
+			err = c.opError("write", os.NewSyscallError("write", syscall.ETIMEDOUT))
 		}
 		c.pool.put(packet)
 		if err != nil {
@@ -204,7 +309,22 @@ func (c *connection) writePacket(packet *packet) {
 	}
 }
 
+//the jitter and the retransmission delay of a packet.
+func (c *connection) randomDelay(r *rand.Rand, state FlowState) time.Duration {
+	connState := c.getState()
+	rtt := connState.Send.Latency + connState.Recv.Latency
+	return sampleJitter(r, state.Latency, state.Jitter, state.Distribution) +
+		retransmitDelay(r, state.LossRate, rtt+minRTO)
+}
+
 func (mc *connection) Write(b []byte) (n int, err error) {
+	if mc.closed() {
+		err = mc.opError("write", net.ErrClosed)
+		return
+	}
+	if err = mc.failError("write"); err != nil {
+		return
+	}
 	for n < len(b) {
 		now := time.Now()
 		packet := mc.pool.get()
@@ -214,21 +334,29 @@ func (mc *connection) Write(b []byte) (n int, err error) {
 		var deadlineTimer <-chan time.Time
 		mc.mutex.Lock()
 		if !mc.writeDeadline.IsZero() {
+			if !now.Before(mc.writeDeadline) {
+				mc.mutex.Unlock()
+				err = mc.opError("write", os.ErrDeadlineExceeded)
+				return
+			}
 			deadlineTimer = time.After(mc.writeDeadline.Sub(now))
 		}
 		mc.mutex.Unlock()
 		select {
-		case err = <-mc.updateErrCh:
-			log.Println(err)
+		case <-mc.failCh:
+			err = mc.failError("write")
 		case err = <-mc.writeErrCh:
 		case <-deadlineTimer:
-			err = errors.New("write timeout")
+			err = mc.opError("write", os.ErrDeadlineExceeded)
 		case mc.writePacketCh <- packet:
 			n += length
 		case <-mc.closeCh:
-			err = errors.New("connection closed")
+			err = mc.opError("write", net.ErrClosed)
 		}
 		if err != nil {
+			if failErr := mc.failError("write"); failErr != nil && !mc.closed() {
+				err = failErr
+			}
 			return
 		}
 	}
@@ -236,10 +364,49 @@ func (mc *connection) Write(b []byte) (n int, err error) {
 }
 
 func (mc *connection) Close() error {
+	mc.mutex.Lock()
+	if mc.closed() {
+		mc.mutex.Unlock()
+		return mc.opError("close", net.ErrClosed)
+	}
 	close(mc.closeCh)
+	//the backend calls below can block, the state updates of the connection shouldn't wait for them.
+	mc.mutex.Unlock()
+	mc.backend.watcher().remove(mc)
+	if mc.ownClientPort {
+		err := mc.backend.ClientDisconnected(mc.clientPort)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	if mc.killed() != "" {
+		//the underlying connection has been closed by kill.
+		return nil
+	}
 	return mc.conn.Close()
 }
 
+func (mc *connection) closed() bool {
+	select {
+	case <-mc.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+//make the error the same as the one returned by net.TCPConn,
+//so it can be checked by net.Error, os.ErrDeadlineExceeded or net.ErrClosed.
+func (mc *connection) opError(op string, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    mc.conn.LocalAddr().Network(),
+		Source: mc.conn.LocalAddr(),
+		Addr:   mc.conn.RemoteAddr(),
+		Err:    err,
+	}
+}
+
 func (mc *connection) LocalAddr() net.Addr {
 	return mc.conn.LocalAddr()
 }
@@ -277,8 +444,9 @@ func (mc *connection) getState() (state *ConnState) {
 	return
 }
 
-func newConnection(conn net.Conn, clientPort, serverPort string) (mConn *connection, err error) {
+func newConnection(backend Backend, conn net.Conn, clientPort, serverPort string) (mConn *connection, err error) {
 	mConn = new(connection)
+	mConn.backend = backend
 	mConn.conn = conn
 	mConn.clientPort = clientPort
 	mConn.serverPort = serverPort
@@ -287,73 +455,130 @@ func newConnection(conn net.Conn, clientPort, serverPort string) (mConn *connect
 	mConn.writePacketCh = make(chan *packet, NumOfPackets)
 	mConn.readPacketCh = make(chan *packet, NumOfPackets)
 	mConn.updateCh = make(chan struct{})
-	mConn.updateErrCh = make(chan error, 1)
+	mConn.failCh = make(chan struct{})
 	mConn.closeCh = make(chan struct{})
+	mConn.sendRand = newRand()
+	mConn.recvRand = newRand()
 
-	connState, err := Cli.ConnState(clientPort, serverPort, nil)
+	//register before getting the initial state, so no change is missed in between.
+	watcher := backend.watcher()
+	watcher.add(mConn)
+	connState, err := backend.ConnState(clientPort, serverPort, nil)
 	if err != nil {
 		log.Println(err)
+		watcher.remove(mConn)
 		return
 	}
-	mConn.connState = connState
+	mConn.mutex.Lock()
+	if mConn.connState == nil {
+		mConn.connState = connState
+	}
+	mConn.mutex.Unlock()
 	go mConn.writeLoop()
 	go mConn.readLoop()
-	go mConn.updateLoop()
 	return
 }
 
-type dialer struct {
-	clientName string
-	timeout    time.Duration
+//Dialer dials servers as a client located at 'ClientName' in the topology.
+//It can be used as the 'DialContext' of http.Transport, or the dialer of other clients.
+type Dialer struct {
+	ClientName string
+	//The max time to wait for a dial to complete, including the simulated latency.
+	//If zero, it is 3 minutes. The deadline of the context is honored as well.
+	Timeout time.Duration
+	//Where the topology is, either an ApiClient or a Network, if nil, 'Cli' is used.
+	Backend Backend
+}
+
+func (d *Dialer) backend() Backend {
+	if d.Backend == nil {
+		return Cli
+	}
+	return d.Backend
+}
+
+func (d *Dialer) Dial(network, serverAddr string) (conn net.Conn, err error) {
+	return d.DialContext(context.Background(), network, serverAddr)
 }
 
-func (d *dialer) dial(network, serverAddr string) (conn net.Conn, err error) {
+//Cancelling the context aborts both the simulated latency and the real dial.
+func (d *Dialer) DialContext(ctx context.Context, network, serverAddr string) (conn net.Conn, err error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = dialTimeOut
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 	serverPort := serverAddr[strings.LastIndex(serverAddr, ":")+1:]
-	state, err := Cli.DialState(d.clientName, serverPort)
+	backend := d.backend()
+	state, err := backend.dialState(ctx, d.ClientName, serverPort)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	r := newRand()
+	latency := state.Latency + sampleJitter(r, state.Latency, state.Jitter, state.Distribution) +
+		retransmitDelay(r, state.LossRate, synRTO)
+	timer := time.NewTimer(latency)
+	defer timer.Stop()
 	select {
-	case <-time.After(time.Duration(state.Latency)):
-		if state.OK {
-			var realConn net.Conn
-			realConn, err = net.Dial(network, serverAddr)
-			if err != nil {
-				return
-			}
-			err = Cli.ClientConnected(d.clientName, localPort(realConn))
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			conn, err = newConnection(realConn, localPort(realConn), remotePort(realConn))
-			if err != nil {
-				log.Println(err)
-				return
-			}
-		} else {
-			err = errors.New("connection error")
-		}
-	case <-time.After(d.timeout):
-		err = errors.New("dial timeout")
+	case <-timer.C:
+	case <-ctx.Done():
+		err = dialError(network, serverAddr, ctx.Err())
+		return
 	}
+	if !state.OK {
+		//a real dial to an unreachable host times out.
+		err = dialError(network, serverAddr, os.NewSyscallError("connect", syscall.ETIMEDOUT))
+		return
+	}
+	var netDialer net.Dialer
+	realConn, err := netDialer.DialContext(ctx, network, serverAddr)
+	if err != nil {
+		return
+	}
+	err = backend.connectionOpened(d.ClientName, localPort(realConn), serverPort)
+	if err != nil {
+		log.Println(err)
+		realConn.Close()
+		return
+	}
+	mConn, err := newConnection(backend, realConn, localPort(realConn), remotePort(realConn))
+	if err != nil {
+		log.Println(err)
+		realConn.Close()
+		backend.ClientDisconnected(localPort(realConn))
+		return
+	}
+	mConn.ownClientPort = true
+	conn = mConn
 	return
 }
 
-func NewDialFunc(clientName string, timeout time.Duration) func(network, addr string) (conn net.Conn, err error) {
-	d := new(dialer)
-	d.clientName = clientName
-	if timeout == 0 {
-		timeout = time.Minute * 3
+//make the error the same as the one returned by net.Dialer.
+func dialError(network, serverAddr string, err error) error {
+	if err == context.DeadlineExceeded {
+		err = os.ErrDeadlineExceeded
 	}
-	d.timeout = timeout
-	return d.dial
+	return &net.OpError{Op: "dial", Net: network, Addr: stringAddr{network, serverAddr}, Err: err}
+}
+
+type stringAddr struct {
+	network, addr string
+}
+
+func (sa stringAddr) Network() string { return sa.network }
+func (sa stringAddr) String() string  { return sa.addr }
+
+func NewDialFunc(clientName string, timeout time.Duration) func(network, addr string) (conn net.Conn, err error) {
+	d := &Dialer{ClientName: clientName, Timeout: timeout}
+	return d.Dial
 }
 
 type listener struct {
-	ol   net.Listener
-	name string
+	ol      net.Listener
+	name    string
+	backend Backend
 }
 
 func (l *listener) Accept() (mConn net.Conn, err error) {
@@ -362,7 +587,7 @@ func (l *listener) Accept() (mConn net.Conn, err error) {
 
 func (l *listener) Close() (err error) {
 	l.ol.Close()
-	err = Cli.ServerStopped(l.name, listenerPort(l.ol))
+	err = l.backend.ServerStopped(l.name, listenerPort(l.ol))
 	if err != nil {
 		log.Println(err)
 		return
@@ -375,22 +600,30 @@ func (l *listener) Addr() net.Addr {
 }
 
 func NewListener(ol net.Listener, name string) (l net.Listener, err error) {
-	err = Cli.ServerStarted(name, listenerPort(ol))
+	return newListener(Cli, ol, name)
+}
+
+func newListener(backend Backend, ol net.Listener, name string) (l net.Listener, err error) {
+	err = backend.ServerStarted(name, listenerPort(ol))
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	l = &listener{ol, name}
+	l = &listener{ol, name, backend}
 	return
 }
 
 func Listen(network, addr, name string) (l net.Listener, err error) {
+	return listen(Cli, network, addr, name)
+}
+
+func listen(backend Backend, network, addr, name string) (l net.Listener, err error) {
 	originListener, err := net.Listen(network, addr)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	l, err = NewListener(originListener, name)
+	l, err = newListener(backend, originListener, name)
 	return
 }
 
@@ -0,0 +1,112 @@
+package stadis
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+//ConnInfo describes an open connection registered by a stadis dialer or proxy.
+type ConnInfo struct {
+	ClientPort int
+	ServerPort int
+	ClientHost string
+	ServerHost string
+	Created    time.Time
+	SentBytes  int64 //bytes from the client to the server, reported by the client process every second.
+	RecvBytes  int64 //bytes from the server to the client.
+	State      ConnState
+	Kill       string `json:",omitempty"` //the kill mode if the connection is killed but not closed yet.
+}
+
+//The modes to kill a connection.
+const (
+	KillReset    = "reset"    //the peers get a RST, like a crashed host or a middlebox dropping the connection.
+	KillGraceful = "graceful" //the peers get a FIN, like the connection is closed by the other side.
+)
+
+//the interval the client process reports the bytes of its connections.
+const connReportInterval = time.Second
+
+//register the client port with the server port it connects to, so it can be listed by 'connections'.
+func (topo *topology) openConn(name string, clientPort, serverPort int) (err error) {
+	err = topo.addClientPort(name, clientPort)
+	if err != nil {
+		return
+	}
+	topo.mutex.Lock()
+	defer topo.mutex.Unlock()
+	info := &ConnInfo{ClientPort: clientPort, ServerPort: serverPort, Created: time.Now()}
+	if host := topo.ports[clientPort]; host != nil {
+		info.ClientHost = host.fullName()
+	}
+	if host := topo.ports[serverPort]; host != nil {
+		info.ServerHost = host.fullName()
+	}
+	topo.conns[clientPort] = info
+	return
+}
+
+//update the bytes reported by the client process.
+func (topo *topology) reportConnBytes(clientPort int, sent, recv int64) {
+	topo.mutex.Lock()
+	if info := topo.conns[clientPort]; info != nil {
+		info.SentBytes = sent
+		info.RecvBytes = recv
+	}
+	topo.mutex.Unlock()
+}
+
+//mark the connection killed, the process owning it kills it on the next state update.
+func (topo *topology) killConn(clientPort, serverPort int, mode string) (err error) {
+	if mode == "" {
+		mode = KillReset
+	}
+	if mode != KillReset && mode != KillGraceful {
+		err = errors.New("unknown kill mode " + mode)
+		log.Println(err)
+		return
+	}
+	topo.mutex.Lock()
+	defer topo.mutex.Unlock()
+	info := topo.conns[clientPort]
+	if info == nil || info.ServerPort != serverPort {
+		err = errors.New("connection not found")
+		log.Println(err)
+		return
+	}
+	info.Kill = mode
+	topo.notifyUpdate()
+	return
+}
+
+func (topo *topology) connKill(clientPort int) (mode string) {
+	topo.mutex.RLock()
+	if info := topo.conns[clientPort]; info != nil {
+		mode = info.Kill
+	}
+	topo.mutex.RUnlock()
+	return
+}
+
+//list the open connections sorted by client port, filtered by the host name of either end
+//and the node prefix of either end, e.g. "animal.land" matches the connections from or to the hosts in it.
+func (topo *topology) connections(host, prefix string) (conns []ConnInfo) {
+	topo.mutex.RLock()
+	defer topo.mutex.RUnlock()
+	conns = []ConnInfo{}
+	for _, info := range topo.conns {
+		if host != "" && info.ClientHost != host && info.ServerHost != host {
+			continue
+		}
+		if prefix != "" && !containsNode(prefix, info.ClientHost) && !containsNode(prefix, info.ServerHost) {
+			continue
+		}
+		conn := *info
+		conn.State, _ = topo.computeConnState(info.ClientPort, info.ServerPort)
+		conns = append(conns, conn)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ClientPort < conns[j].ClientPort })
+	return
+}
@@ -0,0 +1,91 @@
+package stadis
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	UniformDistribution = "uniform"
+	NormalDistribution  = "normal"
+	ParetoDistribution  = "pareto"
+)
+
+//the shape of pareto distribution, the smaller the longer the tail.
+const paretoShape = 2.0
+
+const (
+	minRTO     = 200 * time.Millisecond //the minimum retransmission timeout added to the round trip time.
+	synRTO     = time.Second            //the initial retransmission timeout for SYN packets.
+	maxRTO     = 2 * time.Minute
+	maxRetrans = 15
+)
+
+var (
+	randMu    sync.Mutex
+	randSeed  = time.Now().UnixNano()
+	randCount int64
+)
+
+//Set the seed for random jitters, call it before creating any connection so a test run can be repeated exactly.
+//Each direction of a connection gets its own random source derived from the seed in the order they are created.
+func SetRandSeed(seed int64) {
+	randMu.Lock()
+	randSeed = seed
+	randCount = 0
+	randMu.Unlock()
+}
+
+func newRand() (r *rand.Rand) {
+	randMu.Lock()
+	randCount++
+	r = rand.New(rand.NewSource(randSeed + randCount))
+	randMu.Unlock()
+	return
+}
+
+func validDistribution(distribution string) bool {
+	switch distribution {
+	case "", UniformDistribution, NormalDistribution, ParetoDistribution:
+		return true
+	}
+	return false
+}
+
+//the random variation to be added to the latency, the sum is never negative.
+func sampleJitter(r *rand.Rand, latency, jitter time.Duration, distribution string) (delta time.Duration) {
+	if jitter <= 0 {
+		return
+	}
+	switch distribution {
+	case NormalDistribution:
+		delta = time.Duration(r.NormFloat64() * float64(jitter))
+	case ParetoDistribution:
+		scale := float64(jitter) * (paretoShape - 1)
+		delta = time.Duration(scale * (math.Pow(1-r.Float64(), -1/paretoShape) - 1))
+	default:
+		delta = time.Duration((r.Float64()*2 - 1) * float64(jitter))
+	}
+	if latency+delta < 0 {
+		delta = -latency
+	}
+	return
+}
+
+//the extra delay of a tcp packet caused by retransmissions, every time the packet is lost,
+//it is sent again after the retransmission timeout, which is doubled for the next time.
+func retransmitDelay(r *rand.Rand, lossRate float64, rto time.Duration) (delay time.Duration) {
+	if lossRate <= 0 {
+		return
+	}
+	for i := 0; i < maxRetrans && r.Float64() < lossRate; i++ {
+		delay += rto
+		rto *= 2
+		if rto > maxRTO {
+			rto = maxRTO
+		}
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package stadis
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+//Event types.
+const (
+	EventNodeState          = "nodeState"          //'Name' and 'NodeState' of the node.
+	EventNodeAdded          = "nodeAdded"          //'Name' and 'NodeState' of the node.
+	EventNodeRemoved        = "nodeRemoved"        //'Name' of the node.
+	EventServerStarted      = "serverStarted"      //'Name' of the host and 'Port'.
+	EventServerStopped      = "serverStopped"      //'Name' of the host and 'Port'.
+	EventClientConnected    = "clientConnected"    //'Name' of the host and 'Port', a connection is opened.
+	EventClientDisconnected = "clientDisconnected" //'Name' of the host and 'Port', a connection is closed.
+	EventLinkSet            = "linkSet"            //'Link'.
+	EventLinkRemoved        = "linkRemoved"        //'Link' with 'From' and 'To'.
+	EventConfig             = "config"             //the topology is rebuilt by a new config.
+	EventRestore            = "restore"            //'Name' of the restored snapshot.
+	EventProxyStarted       = "proxyStarted"       //'Proxy'.
+	EventProxyStopped       = "proxyStopped"       //'Proxy'.
+	EventProxyUpdated       = "proxyUpdated"       //'Proxy' with the new 'ClientName'.
+)
+
+//Event is a state change in the network.
+type Event struct {
+	Type      string
+	Time      time.Time
+	Name      string     `json:",omitempty"`
+	Port      int        `json:",omitempty"`
+	NodeState *NodeState `json:",omitempty"`
+	Link      *Link      `json:",omitempty"`
+	Proxy     *Proxy     `json:",omitempty"`
+}
+
+//The number of events buffered for a subscriber, events are dropped if the subscriber is slower.
+const eventBufferSize = 256
+
+//eventHub delivers the events to all the subscribers, it is shared by the topologies of a network,
+//so the subscribers keep receiving events after the config is updated.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan Event]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan Event]bool)}
+}
+
+//publish never blocks, it can be called with the topology locked.
+func (hub *eventHub) publish(ev Event) {
+	if hub == nil {
+		return
+	}
+	ev.Time = time.Now()
+	hub.mu.Lock()
+	for ch := range hub.subs {
+		select {
+		case ch <- ev:
+		default:
+			log.Println("event dropped for slow subscriber", ev.Type)
+		}
+	}
+	hub.mu.Unlock()
+}
+
+func (hub *eventHub) subscribe() (ch chan Event) {
+	ch = make(chan Event, eventBufferSize)
+	hub.mu.Lock()
+	hub.subs[ch] = true
+	hub.mu.Unlock()
+	return
+}
+
+func (hub *eventHub) unsubscribe(ch chan Event) {
+	hub.mu.Lock()
+	delete(hub.subs, ch)
+	hub.mu.Unlock()
+}
@@ -14,7 +14,8 @@ func main() {
 	//Start a api server.
 	go http.ListenAndServe(stadis.Cli.ApiAddr, stadis.NewApiServer())
 	//Setup the http client dialer.
-	http.DefaultTransport.(*http.Transport).Dial = stadis.NewDialFunc("matter.metal.gold", 5*time.Second)
+	dialer := &stadis.Dialer{ClientName: "matter.metal.gold", Timeout: 5 * time.Second}
+	http.DefaultTransport.(*http.Transport).DialContext = dialer.DialContext
 
 	eagleListener, err := stadis.Listen("tcp", "localhost:8585", "animal.air.eagle")
 	if err != nil {
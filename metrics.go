@@ -0,0 +1,183 @@
+package stadis
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+//the upper bounds of the delay histogram buckets in seconds.
+var delayBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+//histogram of durations, safe for concurrent use.
+type histogram struct {
+	counts []int64 //the last one is for +Inf
+	sum    int64   //nanoseconds
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int64, len(delayBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(delayBuckets, seconds)
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	var cumulative int64
+	for i, bound := range delayBuckets {
+		cumulative += atomic.LoadInt64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%v\"} %d\n", name, labels, bound, cumulative)
+	}
+	cumulative += atomic.LoadInt64(&h.counts[len(delayBuckets)])
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, cumulative)
+	fmt.Fprintf(w, "%s_sum{%s} %v\n", name, trimComma(labels), time.Duration(atomic.LoadInt64(&h.sum)).Seconds())
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, trimComma(labels), cumulative)
+}
+
+func trimComma(labels string) string {
+	if len(labels) > 0 && labels[len(labels)-1] == ',' {
+		return labels[:len(labels)-1]
+	}
+	return labels
+}
+
+//The simulated delays of the data delivered by the connections in this process, including the proxied ones.
+var (
+	sendDelays = newHistogram()
+	recvDelays = newHistogram()
+)
+
+//the metrics of a network, updated atomically.
+type networkMetrics struct {
+	dialFailures    int64 //dials refused because the dial state is not OK.
+	longPollWaiters int64 //ConnState requests blocking for a new state.
+	watchStreams    int64 //open watch streams.
+}
+
+//write the metrics of the namespaces in Prometheus text format.
+func (s *ApiServer) writeMetrics(w io.Writer) {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.namespaces))
+	for name := range s.namespaces {
+		names = append(names, name)
+	}
+	namespaces := make(map[string]*namespace, len(s.namespaces))
+	for name, ns := range s.namespaces {
+		namespaces[name] = ns
+	}
+	s.mu.RUnlock()
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP stadis_server_ports Number of registered server ports per host.")
+	fmt.Fprintln(w, "# TYPE stadis_server_ports gauge")
+	for _, name := range names {
+		namespaces[name].topology().writePortMetrics(w, name, serverPortType)
+	}
+	fmt.Fprintln(w, "# HELP stadis_client_ports Number of registered client ports per host.")
+	fmt.Fprintln(w, "# TYPE stadis_client_ports gauge")
+	for _, name := range names {
+		namespaces[name].topology().writePortMetrics(w, name, clientPortType)
+	}
+
+	fmt.Fprintln(w, "# HELP stadis_proxy_active_connections Number of connections being proxied.")
+	fmt.Fprintln(w, "# TYPE stadis_proxy_active_connections gauge")
+	for _, name := range names {
+		for _, ps := range namespaces[name].sortedProxies() {
+			fmt.Fprintf(w, "stadis_proxy_active_connections{namespace=%q,proxy_port=%q,proxy_name=%q} %d\n",
+				name, ps.proxyPort, ps.proxyName, atomic.LoadInt64(&ps.activeConns))
+		}
+	}
+	fmt.Fprintln(w, "# HELP stadis_proxy_relayed_bytes_total Bytes relayed by the proxy, upstream is from the client to the origin.")
+	fmt.Fprintln(w, "# TYPE stadis_proxy_relayed_bytes_total counter")
+	for _, name := range names {
+		for _, ps := range namespaces[name].sortedProxies() {
+			fmt.Fprintf(w, "stadis_proxy_relayed_bytes_total{namespace=%q,proxy_port=%q,direction=\"upstream\"} %d\n",
+				name, ps.proxyPort, atomic.LoadInt64(&ps.upstreamBytes))
+			fmt.Fprintf(w, "stadis_proxy_relayed_bytes_total{namespace=%q,proxy_port=%q,direction=\"downstream\"} %d\n",
+				name, ps.proxyPort, atomic.LoadInt64(&ps.downstreamBytes))
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP stadis_dial_failures_total Dials refused because the network between the client and the server is down.")
+	fmt.Fprintln(w, "# TYPE stadis_dial_failures_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "stadis_dial_failures_total{namespace=%q} %d\n", name, atomic.LoadInt64(&namespaces[name].network.metrics.dialFailures))
+	}
+	fmt.Fprintln(w, "# HELP stadis_long_poll_waiters Number of connState requests waiting for a new state.")
+	fmt.Fprintln(w, "# TYPE stadis_long_poll_waiters gauge")
+	for _, name := range names {
+		fmt.Fprintf(w, "stadis_long_poll_waiters{namespace=%q} %d\n", name, atomic.LoadInt64(&namespaces[name].network.metrics.longPollWaiters))
+	}
+	fmt.Fprintln(w, "# HELP stadis_watch_streams Number of open watch streams.")
+	fmt.Fprintln(w, "# TYPE stadis_watch_streams gauge")
+	for _, name := range names {
+		fmt.Fprintf(w, "stadis_watch_streams{namespace=%q} %d\n", name, atomic.LoadInt64(&namespaces[name].network.metrics.watchStreams))
+	}
+
+	fmt.Fprintln(w, "# HELP stadis_simulated_delay_seconds Simulated delay of the data delivered by the connections in the API server process.")
+	fmt.Fprintln(w, "# TYPE stadis_simulated_delay_seconds histogram")
+	sendDelays.write(w, "stadis_simulated_delay_seconds", `direction="send",`)
+	recvDelays.write(w, "stadis_simulated_delay_seconds", `direction="recv",`)
+}
+
+func (topo *topology) writePortMetrics(w io.Writer, namespace string, portType bool) {
+	metric := "stadis_server_ports"
+	if portType == clientPortType {
+		metric = "stadis_client_ports"
+	}
+	topo.mutex.RLock()
+	defer topo.mutex.RUnlock()
+	var hosts []*host
+	topo.eachNode(func(nod node) {
+		if h, ok := nod.(*host); ok {
+			hosts = append(hosts, h)
+		}
+	})
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].fullName() < hosts[j].fullName() })
+	for _, h := range hosts {
+		count := 0
+		for _, t := range h.portMap {
+			if t == portType {
+				count++
+			}
+		}
+		if count > 0 {
+			fmt.Fprintf(w, "%s{namespace=%q,host=%q} %d\n", metric, namespace, h.fullName(), count)
+		}
+	}
+}
+
+func (ns *namespace) sortedProxies() (proxies []*proxyServer) {
+	ns.mu.RLock()
+	for _, ps := range ns.proxies {
+		if ps != nil {
+			proxies = append(proxies, ps)
+		}
+	}
+	ns.mu.RUnlock()
+	sort.Slice(proxies, func(i, j int) bool {
+		pi, _ := strconv.Atoi(proxies[i].proxyPort)
+		pj, _ := strconv.Atoi(proxies[j].proxyPort)
+		return pi < pj
+	})
+	return
+}
+
+//countWriter counts the bytes written through it.
+type countWriter struct {
+	w     io.Writer
+	count *int64
+}
+
+func (cw countWriter) Write(b []byte) (n int, err error) {
+	n, err = cw.w.Write(b)
+	atomic.AddInt64(cw.count, int64(n))
+	return
+}
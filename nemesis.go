@@ -0,0 +1,218 @@
+package stadis
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//Fault types of the nemesis.
+const (
+	FaultInternalDown = "internalDown" //set 'InternalDown' on a random node.
+	FaultExternalDown = "externalDown" //set 'ExternalDown' on a random node.
+	FaultLatency      = "latency"      //set the latency of a random node to 'SpikeLatency'.
+	FaultPartition    = "partition"    //add a down link between two random nodes.
+)
+
+//Nemesis applies random faults to random nodes, one at a time, and heals each of them after 'Duration'.
+//The same seed and faults pick the same nodes in the same order on the same topology.
+type Nemesis struct {
+	Seed         int64
+	Faults       []string      //the fault types to choose from.
+	Interval     time.Duration //the mean time between a heal and the next fault, 1s if zero.
+	Duration     time.Duration //how long a fault lasts, 1s if zero.
+	SpikeLatency time.Duration //the latency of the latency fault, 500ms if zero.
+}
+
+//NemesisStatus reports the actions the nemesis took, the latest 100 are kept.
+type NemesisStatus struct {
+	Running bool
+	Actions []string
+}
+
+const maxNemesisActions = 100
+
+type nemesisRunner struct {
+	mu      sync.Mutex
+	running bool
+	actions []string
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+func (runner *nemesisRunner) logAction(format string, a ...interface{}) {
+	action := time.Now().Format("15:04:05.000 ") + fmt.Sprintf(format, a...)
+	log.Println("nemesis:", action)
+	runner.mu.Lock()
+	runner.actions = append(runner.actions, action)
+	if len(runner.actions) > maxNemesisActions {
+		runner.actions = runner.actions[len(runner.actions)-maxNemesisActions:]
+	}
+	runner.mu.Unlock()
+}
+
+//start the nemesis in background, only one nemesis can run in a namespace at a time.
+func (ns *namespace) startNemesis(nemesis Nemesis) (err error) {
+	if len(nemesis.Faults) == 0 {
+		err = errors.New("'Faults' required")
+		log.Println(err)
+		return
+	}
+	for _, fault := range nemesis.Faults {
+		switch fault {
+		case FaultInternalDown, FaultExternalDown, FaultLatency, FaultPartition:
+		default:
+			err = errors.New("unknown fault " + fault)
+			log.Println(err)
+			return
+		}
+	}
+	if nemesis.Interval < 0 || nemesis.Duration < 0 {
+		err = errors.New("'Interval' and 'Duration' can't be negative")
+		log.Println(err)
+		return
+	}
+	if nemesis.Interval == 0 {
+		nemesis.Interval = time.Second
+	}
+	if nemesis.Duration == 0 {
+		nemesis.Duration = time.Second
+	}
+	if nemesis.SpikeLatency == 0 {
+		nemesis.SpikeLatency = 500 * time.Millisecond
+	}
+	runner := &ns.nemesis
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if runner.running {
+		err = errors.New("nemesis is running")
+		log.Println(err)
+		return
+	}
+	runner.running = true
+	runner.actions = nil
+	runner.stopCh = make(chan struct{})
+	runner.doneCh = make(chan struct{})
+	go ns.runNemesis(nemesis, runner.stopCh, runner.doneCh)
+	return
+}
+
+func (ns *namespace) runNemesis(nemesis Nemesis, stopCh, doneCh chan struct{}) {
+	defer close(doneCh)
+	runner := &ns.nemesis
+	r := rand.New(rand.NewSource(nemesis.Seed))
+	runner.logAction("start with seed %v, faults %v", nemesis.Seed, nemesis.Faults)
+	for {
+		select {
+		case <-stopCh:
+			runner.logAction("stop")
+			return
+		case <-time.After(time.Duration(r.Int63n(int64(2 * nemesis.Interval)))):
+		}
+		heal := ns.applyFault(nemesis, r)
+		if heal == nil {
+			continue
+		}
+		select {
+		case <-stopCh:
+		case <-time.After(nemesis.Duration):
+		}
+		heal()
+	}
+}
+
+//apply a random fault to the current topology, the returned function heals it.
+func (ns *namespace) applyFault(nemesis Nemesis, r *rand.Rand) (heal func()) {
+	runner := &ns.nemesis
+	topo := ns.topology()
+	names := topo.nodeNames()
+	fault := nemesis.Faults[r.Intn(len(nemesis.Faults))]
+	//the topology can be empty, e.g. all the data centers are removed.
+	if len(names) == 0 {
+		runner.logAction("skip %v, no node in the topology", fault)
+		return
+	}
+	name := names[r.Intn(len(names))]
+	if fault == FaultPartition {
+		other := names[r.Intn(len(names))]
+		if containsNode(name, other) || containsNode(other, name) {
+			runner.logAction("skip partition between %v and %v", name, other)
+			return
+		}
+		oldLink, linkErr := topo.link(name, other)
+		err := topo.setLink(Link{From: name, To: other, Down: true})
+		if err != nil {
+			runner.logAction("failed to partition %v from %v: %v", name, other, err)
+			return
+		}
+		runner.logAction("partition %v from %v", name, other)
+		return func() {
+			topo := ns.topology()
+			if linkErr == nil {
+				err = topo.setLink(oldLink)
+			} else {
+				err = topo.removeLink(name, other)
+			}
+			if err != nil {
+				runner.logAction("failed to heal partition between %v and %v: %v", name, other, err)
+				return
+			}
+			runner.logAction("heal partition between %v and %v", name, other)
+		}
+	}
+	oldState, err := topo.nodeState(name)
+	if err != nil {
+		runner.logAction("failed to get state of %v: %v", name, err)
+		return
+	}
+	newState := oldState
+	switch fault {
+	case FaultInternalDown:
+		newState.InternalDown = true
+	case FaultExternalDown:
+		newState.ExternalDown = true
+	case FaultLatency:
+		newState.Latency = nemesis.SpikeLatency
+	}
+	err = topo.setNodeState(name, newState)
+	if err != nil {
+		runner.logAction("failed to apply %v to %v: %v", fault, name, err)
+		return
+	}
+	runner.logAction("apply %v to %v", fault, name)
+	return func() {
+		err := ns.topology().resetNodeState(name, oldState)
+		if err != nil {
+			runner.logAction("failed to heal %v on %v: %v", fault, name, err)
+			return
+		}
+		runner.logAction("heal %v on %v", fault, name)
+	}
+}
+
+//stop the nemesis and wait for the current fault to be healed.
+func (ns *namespace) stopNemesis() {
+	runner := &ns.nemesis
+	runner.mu.Lock()
+	if !runner.running {
+		runner.mu.Unlock()
+		return
+	}
+	runner.running = false
+	close(runner.stopCh)
+	doneCh := runner.doneCh
+	runner.mu.Unlock()
+	<-doneCh
+}
+
+func (ns *namespace) nemesisStatus() (status NemesisStatus) {
+	runner := &ns.nemesis
+	runner.mu.Lock()
+	status.Running = runner.running
+	status.Actions = append([]string{}, runner.actions...)
+	runner.mu.Unlock()
+	return
+}
@@ -0,0 +1,368 @@
+package stadis
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Backend holds the topology for connections, listeners and dialers.
+//ApiClient accesses the topology through the API server, Network accesses it in memory.
+type Backend interface {
+	ServerStarted(name, port string) error
+	ServerStopped(name, port string) error
+	ClientConnected(name, port string) error
+	ClientDisconnected(port string) error
+	DialState(clientName, serverPort string) (DialState, error)
+	ConnState(clientPort, serverPort string, oldState *ConnState) (*ConnState, error)
+	PacketState(clientName, serverPort string) (FlowState, error)
+	dialState(ctx context.Context, clientName, serverPort string) (DialState, error)
+	watcher() *connWatcher
+	//call 'changed' when the topology is changed, until the context is done or the stream is broken.
+	watchChanges(ctx context.Context, changed func()) error
+	connStates(ports []connPorts) ([]connStateResult, error)
+	//register the client port of a connection to the server port.
+	connectionOpened(name, clientPort, serverPort string) error
+	//take n bytes from the limited uplinks, return the time to wait before the bytes can be sent.
+	reserveUplinks(uplinks []Uplink, n int) time.Duration
+}
+
+//The max time ConnState blocks when 'oldState' is provided and no new state is updated.
+const longPollTimeout = 3 * time.Second
+
+//Network is an embedded stadis network in the local process, it holds the topology in memory,
+//so connections get their states without the API server, which makes unit tests faster and independent.
+//The REST API can be mounted on top of it by 'NewNetworkApiServer'.
+type Network struct {
+	mu          sync.RWMutex
+	topo        *topology
+	events      *eventHub
+	watcherOnce sync.Once
+	connWatcher *connWatcher
+	metrics     networkMetrics
+	bucketSet   *bucketSet
+}
+
+//Create a network with 'DefaultConfig'.
+func NewNetwork() (n *Network) {
+	n = new(Network)
+	n.events = newEventHub()
+	n.bucketSet = newBucketSet()
+	n.topo, _ = newTopology(bytes.NewReader(DefaultConfig))
+	n.topo.events = n.events
+	return
+}
+
+func (n *Network) topology() (topo *topology) {
+	n.mu.RLock()
+	topo = n.topo
+	n.mu.RUnlock()
+	return
+}
+
+//Rebuild the topology with the config, the same as 'ApiClient.UpdateConfig'.
+func (n *Network) UpdateConfig(reader io.Reader) (err error) {
+	topo, err := newTopology(reader)
+	if err != nil {
+		return
+	}
+	topo.events = n.events
+	n.mu.Lock()
+	//wake up all the blocking requests, they will find their ports are gone.
+	n.topo.discard()
+	n.topo = topo
+	n.mu.Unlock()
+	n.events.publish(Event{Type: EventConfig})
+	return
+}
+
+//Rebuild the topology with the config but keep the registered ports whose hosts still exist,
+//the live connections get their new states, the same as 'ApiClient.MergeConfig'.
+func (n *Network) MergeConfig(reader io.Reader) (err error) {
+	topo, err := newTopology(reader)
+	if err != nil {
+		return
+	}
+	topo.events = n.events
+	n.mu.Lock()
+	topo.mergePorts(n.topo)
+	n.topo.discard()
+	n.topo = topo
+	n.mu.Unlock()
+	n.events.publish(Event{Type: EventConfig})
+	return
+}
+
+//Get the live topology as a config, the same as 'ApiClient.Config'.
+func (n *Network) Config() (*Config, error) {
+	return n.topology().config(), nil
+}
+
+//wake up all the blocking requests when the network is discarded.
+func (n *Network) close() {
+	n.topology().discard()
+}
+
+func (n *Network) ServerStarted(name, port string) (err error) {
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return
+	}
+	return n.topology().addServerPort(name, portNum)
+}
+
+func (n *Network) ServerStopped(name, port string) (err error) {
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return
+	}
+	return n.topology().removeServerPort(name, portNum)
+}
+
+func (n *Network) ClientConnected(name, port string) (err error) {
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return
+	}
+	return n.topology().addClientPort(name, portNum)
+}
+
+func (n *Network) connectionOpened(name, clientPort, serverPort string) (err error) {
+	clientPortNum, err := strconv.Atoi(clientPort)
+	if err != nil {
+		return
+	}
+	serverPortNum, err := strconv.Atoi(serverPort)
+	if err != nil {
+		return
+	}
+	return n.topology().openConn(name, clientPortNum, serverPortNum)
+}
+
+func (n *Network) ClientDisconnected(port string) (err error) {
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return
+	}
+	return n.topology().removeClientPort(portNum)
+}
+
+func (n *Network) DialState(clientName, serverPort string) (state DialState, err error) {
+	portNum, err := strconv.Atoi(serverPort)
+	if err != nil {
+		return
+	}
+	state, err = n.topology().dialState(clientName, portNum)
+	if err == nil && !state.OK {
+		atomic.AddInt64(&n.metrics.dialFailures, 1)
+	}
+	return
+}
+
+func (n *Network) dialState(ctx context.Context, clientName, serverPort string) (DialState, error) {
+	return n.DialState(clientName, serverPort)
+}
+
+//Get the current connection state, if 'oldState' is provided, it blocks until the state is changed
+//or a few seconds passed, the same as 'ApiClient.ConnState'.
+func (n *Network) ConnState(clientPort, serverPort string, oldState *ConnState) (state *ConnState, err error) {
+	clientPortNum, err := strconv.Atoi(clientPort)
+	if err != nil {
+		return
+	}
+	serverPortNum, err := strconv.Atoi(serverPort)
+	if err != nil {
+		return
+	}
+	topo := n.topology()
+	updateCh := topo.getUpdateChannel()
+	connState, err := topo.connState(clientPortNum, serverPortNum)
+	if err != nil {
+		return
+	}
+	if oldState != nil && oldState.equal(&connState) {
+		atomic.AddInt64(&n.metrics.longPollWaiters, 1)
+		defer atomic.AddInt64(&n.metrics.longPollWaiters, -1)
+		select {
+		case <-time.After(longPollTimeout):
+		case <-updateCh:
+			//the topology may have been replaced by a new config.
+			topo = n.topology()
+			connState, err = topo.connState(clientPortNum, serverPortNum)
+			if err != nil {
+				return
+			}
+		}
+		if oldState.equal(&connState) {
+			state = oldState
+			return
+		}
+	}
+	state = &connState
+	return
+}
+
+func (n *Network) reserveUplinks(uplinks []Uplink, bytes int) time.Duration {
+	return n.bucketSet.reserve(uplinks, bytes)
+}
+
+func (n *Network) watcher() *connWatcher {
+	n.watcherOnce.Do(func() {
+		n.connWatcher = newConnWatcher(n)
+	})
+	return n.connWatcher
+}
+
+func (n *Network) watchChanges(ctx context.Context, changed func()) error {
+	for {
+		//get the channel before the states, so no change is missed.
+		updateCh := n.topology().getUpdateChannel()
+		changed()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-updateCh:
+		}
+	}
+}
+
+func (n *Network) connStates(ports []connPorts) (results []connStateResult, err error) {
+	topo := n.topology()
+	results = make([]connStateResult, len(ports))
+	for i, p := range ports {
+		clientPort, err1 := strconv.Atoi(p.ClientPort)
+		serverPort, err2 := strconv.Atoi(p.ServerPort)
+		if err1 != nil || err2 != nil {
+			results[i].Err = "invalid port"
+			continue
+		}
+		if p.SentBytes > 0 || p.RecvBytes > 0 {
+			topo.reportConnBytes(clientPort, p.SentBytes, p.RecvBytes)
+		}
+		state, err := topo.connState(clientPort, serverPort)
+		if err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		results[i].State = &state
+		results[i].Kill = topo.connKill(clientPort)
+	}
+	return
+}
+
+func (n *Network) PacketState(clientName, serverPort string) (state FlowState, err error) {
+	portNum, err := strconv.Atoi(serverPort)
+	if err != nil {
+		return
+	}
+	return n.topology().packetState(clientName, portNum)
+}
+
+//List the open connections, the same as 'ApiClient.Connections'.
+func (n *Network) Connections(host, prefix string) ([]ConnInfo, error) {
+	return n.topology().connections(host, prefix), nil
+}
+
+//Kill the connection, the same as 'ApiClient.KillConnection'.
+func (n *Network) KillConnection(clientPort, serverPort int, mode string) error {
+	return n.topology().killConn(clientPort, serverPort, mode)
+}
+
+func (n *Network) NodeState(name string) (NodeState, error) {
+	return n.topology().nodeState(name)
+}
+
+//Set the node's state, the same as 'ApiClient.UpdateNodeState'.
+func (n *Network) UpdateNodeState(name string, nodeState NodeState) error {
+	return n.topology().setNodeState(name, nodeState)
+}
+
+//Insert a node into the network, the same as 'ApiClient.AddNode'.
+func (n *Network) AddNode(name string, state *NodeState) error {
+	return n.topology().addNode(name, state)
+}
+
+//Delete a node from the network, the same as 'ApiClient.RemoveNode'.
+func (n *Network) RemoveNode(name string, force bool) error {
+	return n.topology().removeNode(name, force)
+}
+
+func (n *Network) UpdateLink(link Link) error {
+	return n.topology().setLink(link)
+}
+
+func (n *Network) RemoveLink(from, to string) error {
+	return n.topology().removeLink(from, to)
+}
+
+func (n *Network) Link(from, to string) (Link, error) {
+	return n.topology().link(from, to)
+}
+
+func (n *Network) Links() ([]Link, error) {
+	return n.topology().allLinks(), nil
+}
+
+//Save the node and link states as a named snapshot, the same as 'ApiClient.Snapshot'.
+func (n *Network) Snapshot(name string) error {
+	return n.topology().saveSnapshot(name)
+}
+
+func (n *Network) Restore(name string) error {
+	return n.topology().restoreSnapshot(name)
+}
+
+func (n *Network) DeleteSnapshot(name string) error {
+	return n.topology().deleteSnapshot(name)
+}
+
+//Get the stream of state changes in the network until the context is done, the same as 'ApiClient.Events'.
+//Events are dropped if the receiver is too slow.
+func (n *Network) Events(ctx context.Context) (<-chan Event, error) {
+	ch := n.events.subscribe()
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		defer n.events.unsubscribe(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-ch:
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+//Listen on the address, the listener is located at 'name' in the network.
+func (n *Network) Listen(network, addr, name string) (net.Listener, error) {
+	return listen(n, network, addr, name)
+}
+
+func (n *Network) NewListener(ol net.Listener, name string) (net.Listener, error) {
+	return newListener(n, ol, name)
+}
+
+func (n *Network) ListenPacket(network, addr, name string) (net.PacketConn, error) {
+	return listenPacket(n, network, addr, name)
+}
+
+func (n *Network) NewPacketConn(opc net.PacketConn, name string) (net.PacketConn, error) {
+	return newPacketConn(n, opc, name)
+}
+
+//Get a dialer dials servers as a client located at 'clientName' in the network.
+func (n *Network) Dialer(clientName string, timeout time.Duration) *Dialer {
+	return &Dialer{ClientName: clientName, Timeout: timeout, Backend: n}
+}
@@ -0,0 +1,216 @@
+package stadis
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//How long the packet state of a destination is cached before asking the API server again,
+//the cached states are dropped earlier when the topology is changed.
+var PacketStateTTL = time.Second
+
+//returned by the backend if the destination port is not registered, the datagrams to it are not simulated.
+var errPortNotRegistered = errors.New("port not registered")
+
+type packetState struct {
+	state     FlowState
+	simulated bool //false if the destination port is not registered, datagrams are sent directly.
+	expire    time.Time
+	gen       int //the generation of the topology the state is fetched in.
+}
+
+//packetConn simulates the network on the sending side, every datagram written to it is delayed,
+//dropped or duplicated according to the state between its host and the host of the destination port.
+//Datagrams are delivered independently, so the ones with less delay arrive earlier, which reorders them.
+type packetConn struct {
+	net.PacketConn
+	backend Backend
+	name    string
+	port    string
+	mutex   sync.Mutex
+	states  map[string]*packetState //destination port to packet state
+	gen     int                     //increased when the topology is changed, the cached states expire with it.
+	rand    *rand.Rand
+	closeCh chan struct{}
+}
+
+//the cached state is used until it expires or the topology is changed.
+//If the state can't be fetched, the last known state is kept, nil if there isn't one, the datagram should be dropped.
+func (pc *packetConn) getState(dstPort string) (ps *packetState) {
+	now := time.Now()
+	pc.mutex.Lock()
+	last := pc.states[dstPort]
+	gen := pc.gen
+	pc.mutex.Unlock()
+	if last != nil && last.gen == gen && now.Before(last.expire) {
+		return last
+	}
+	state, err := pc.backend.PacketState(pc.name, dstPort)
+	switch err {
+	case nil:
+		ps = &packetState{state: state, simulated: true}
+	case errPortNotRegistered:
+		ps = &packetState{}
+	default:
+		log.Println(err)
+		if last == nil {
+			return
+		}
+		ps = &packetState{state: last.state, simulated: last.simulated}
+	}
+	ps.expire = now.Add(PacketStateTTL)
+	ps.gen = gen
+	pc.mutex.Lock()
+	pc.states[dstPort] = ps
+	pc.mutex.Unlock()
+	return
+}
+
+//called by the watcher when the topology is changed.
+func (pc *packetConn) invalidate() {
+	pc.mutex.Lock()
+	pc.gen++
+	pc.mutex.Unlock()
+}
+
+func (pc *packetConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	if pc.closed() {
+		err = pc.opError("write", addr, net.ErrClosed)
+		return
+	}
+	addrStr := addr.String()
+	ps := pc.getState(addrStr[strings.LastIndex(addrStr, ":")+1:])
+	n = len(b)
+	if ps == nil {
+		//the state is unknown, the datagram is dropped.
+		return
+	}
+	if !ps.simulated {
+		return pc.PacketConn.WriteTo(b, addr)
+	}
+	state := ps.state
+	if !state.OK {
+		return
+	}
+	pc.mutex.Lock()
+	lost := pc.rand.Float64() < state.LossRate
+	copies := 1
+	if pc.rand.Float64() < state.DupRate {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = state.Latency + sampleJitter(pc.rand, state.Latency, state.Jitter, state.Distribution)
+	}
+	pc.mutex.Unlock()
+	if lost {
+		return
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	for _, delay := range delays {
+		if len(state.Uplinks) > 0 {
+			delay += pc.backend.reserveUplinks(state.Uplinks, len(data))
+		}
+		time.AfterFunc(delay, func() {
+			select {
+			case <-pc.closeCh:
+				return
+			default:
+			}
+			_, err := pc.PacketConn.WriteTo(data, addr)
+			if err != nil {
+				log.Println(err)
+			}
+		})
+	}
+	return
+}
+
+func (pc *packetConn) Close() (err error) {
+	pc.mutex.Lock()
+	if pc.closed() {
+		pc.mutex.Unlock()
+		return pc.opError("close", nil, net.ErrClosed)
+	}
+	close(pc.closeCh)
+	pc.mutex.Unlock()
+	pc.backend.watcher().removePacketConn(pc)
+	pc.PacketConn.Close()
+	err = pc.backend.ServerStopped(pc.name, pc.port)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	return
+}
+
+func (pc *packetConn) closed() bool {
+	select {
+	case <-pc.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+//the same error as the one returned by net.UDPConn, so it can be checked by net.ErrClosed.
+func (pc *packetConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    pc.LocalAddr().Network(),
+		Source: pc.LocalAddr(),
+		Addr:   addr,
+		Err:    err,
+	}
+}
+
+//Wrap an existing packet connection, register its port as a server port located at 'name'.
+//Both sides should use a stadis packet connection, as the network is simulated on the sending side.
+func NewPacketConn(opc net.PacketConn, name string) (pc net.PacketConn, err error) {
+	return newPacketConn(Cli, opc, name)
+}
+
+func newPacketConn(backend Backend, opc net.PacketConn, name string) (pc net.PacketConn, err error) {
+	addr := opc.LocalAddr().String()
+	port := addr[strings.LastIndex(addr, ":")+1:]
+	err = backend.ServerStarted(name, port)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	packetConn := &packetConn{
+		PacketConn: opc,
+		backend:    backend,
+		name:       name,
+		port:       port,
+		states:     make(map[string]*packetState),
+		rand:       newRand(),
+		closeCh:    make(chan struct{}),
+	}
+	backend.watcher().addPacketConn(packetConn)
+	pc = packetConn
+	return
+}
+
+func ListenPacket(network, addr, name string) (pc net.PacketConn, err error) {
+	return listenPacket(Cli, network, addr, name)
+}
+
+func listenPacket(backend Backend, network, addr, name string) (pc net.PacketConn, err error) {
+	originConn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	pc, err = newPacketConn(backend, originConn, name)
+	if err != nil {
+		originConn.Close()
+	}
+	return
+}
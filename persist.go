@@ -0,0 +1,83 @@
+package stadis
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+//The file in the state directory holding the config of the default namespace.
+const stateFileName = "state.json"
+
+//Persist the default namespace in the directory, the config, node states, links and proxies are written
+//to it on every change. If the directory has a saved state, it is restored first, the proxies are started
+//on the same ports and their server ports are registered again.
+func (s *ApiServer) PersistState(dir string) (err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ns := s.getNamespace("")
+	fileName := filepath.Join(dir, stateFileName)
+	data, err := ioutil.ReadFile(fileName)
+	if err == nil {
+		err = ns.updateConfig(data, false)
+		if err != nil {
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		log.Println(err)
+		return
+	}
+	ch := ns.network.events.subscribe()
+	err = ns.saveState(fileName)
+	if err != nil {
+		ns.network.events.unsubscribe(ch)
+		return
+	}
+	go ns.persistLoop(ch, fileName)
+	return
+}
+
+//save the state after the events, the events arrived during a save are saved together.
+func (ns *namespace) persistLoop(ch chan Event, fileName string) {
+	for ev := range ch {
+		changed := isStateEvent(ev)
+	drain:
+		for {
+			select {
+			case ev = <-ch:
+				changed = changed || isStateEvent(ev)
+			default:
+				break drain
+			}
+		}
+		if changed {
+			ns.saveState(fileName)
+		}
+	}
+}
+
+//the client ports are not in the config, they are registered again when the clients reconnect.
+func isStateEvent(ev Event) bool {
+	return ev.Type != EventClientConnected && ev.Type != EventClientDisconnected
+}
+
+//write to a temporary file then rename it, so a crash never leaves a partial state.
+func (ns *namespace) saveState(fileName string) (err error) {
+	data, _ := json.MarshalIndent(ns.config(), "", "\t")
+	tmpName := fileName + ".tmp"
+	err = ioutil.WriteFile(tmpName, data, 0644)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = os.Rename(tmpName, fileName)
+	if err != nil {
+		log.Println(err)
+	}
+	return
+}
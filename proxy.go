@@ -5,11 +5,17 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type proxyServer struct {
+	activeConns     int64 //accessed atomically, the same below.
+	upstreamBytes   int64
+	downstreamBytes int64
+
 	mu         sync.RWMutex
+	backend    Backend
 	clientName string
 	proxyName  string
 	proxyPort  string
@@ -17,8 +23,9 @@ type proxyServer struct {
 	listener   net.Listener
 }
 
-func newProxyServer(clientName, proxyName, proxyPort, originAddr string) (ps *proxyServer, err error) {
+func newProxyServer(backend Backend, clientName, proxyName, proxyPort, originAddr string) (ps *proxyServer, err error) {
 	ps = new(proxyServer)
+	ps.backend = backend
 	ps.clientName = clientName
 	ps.proxyName = proxyName
 	ps.proxyPort = proxyPort
@@ -28,7 +35,7 @@ func newProxyServer(clientName, proxyName, proxyPort, originAddr string) (ps *pr
 		log.Println("failed to listen proxy", err)
 		return
 	}
-	err = Cli.ServerStarted(ps.proxyName, ps.proxyPort)
+	err = ps.backend.ServerStarted(ps.proxyName, ps.proxyPort)
 	if err != nil {
 		log.Println("at newProxyServer", err)
 		return
@@ -43,37 +50,46 @@ func (ps *proxyServer) serve() {
 			return
 		}
 
+		//a failed connection only fails its client, the proxy keeps accepting.
 		originConn, err := net.DialTimeout("tcp", ps.originAddr, time.Second)
 		if err != nil {
 			log.Println(err)
 			downstream.Close()
-			return
+			continue
 		}
 		clientPort := remotePort(downstream)
-		err = Cli.ClientConnected(ps.getClientName(), clientPort)
+		err = ps.backend.connectionOpened(ps.getClientName(), clientPort, ps.proxyPort)
 		if err != nil {
 			log.Printf("%v, clinetPort:%s\n", err, clientPort)
-			return
+			downstream.Close()
+			originConn.Close()
+			continue
 		}
 
 		//the delay and failing happens on this upstream conn.
-		upstream, err := newConnection(originConn, clientPort, ps.proxyPort)
+		upstream, err := newConnection(ps.backend, originConn, clientPort, ps.proxyPort)
 		if err != nil {
 			log.Println(err)
+			ps.backend.ClientDisconnected(clientPort)
 			downstream.Close()
 			originConn.Close()
-			return
+			continue
 		}
-		go handleCopy(downstream, upstream)
+		atomic.AddInt64(&ps.activeConns, 1)
+		go ps.handleCopy(downstream, upstream)
 	}
 }
 
 func (ps *proxyServer) close() (err error) {
 	ps.listener.Close()
-	err = Cli.ServerStopped(ps.proxyName, ps.proxyPort)
+	err = ps.backend.ServerStopped(ps.proxyName, ps.proxyPort)
 	return
 }
 
+func (ps *proxyServer) info() *Proxy {
+	return &Proxy{ClientName: ps.getClientName(), ProxyName: ps.proxyName, ProxyPort: ps.proxyPort, OriginAddr: ps.originAddr}
+}
+
 func (ps *proxyServer) setClientName(clientName string) {
 	ps.mu.Lock()
 	ps.clientName = clientName
@@ -87,23 +103,31 @@ func (ps *proxyServer) getClientName() (clientName string) {
 	return
 }
 
-func handleCopy(downstream, upstream net.Conn) {
+func (ps *proxyServer) handleCopy(downstream, upstream net.Conn) {
 	done := make(chan bool)
 	go func() {
-		n, err := io.Copy(downstream, upstream)
+		n, err := io.Copy(countWriter{downstream, &ps.downstreamBytes}, upstream)
 		if err != nil {
 			log.Println(n, err)
 		}
+		if mc, ok := upstream.(*connection); ok && mc.killed() != "" {
+			//kill the client of the proxy as well, it is blocked on reading the downstream otherwise.
+			if tcpConn, ok := downstream.(*net.TCPConn); ok && mc.killed() == KillReset {
+				tcpConn.SetLinger(0)
+			}
+			downstream.Close()
+		}
 		done <- true
 	}()
-	n, err := io.Copy(upstream, downstream)
+	n, err := io.Copy(countWriter{upstream, &ps.upstreamBytes}, downstream)
 	if err != nil {
 		log.Println(n, err)
 	}
 	<-done
 	upstream.Close()
 	downstream.Close()
-	err = Cli.ClientDisconnected(remotePort(downstream))
+	atomic.AddInt64(&ps.activeConns, -1)
+	err = ps.backend.ClientDisconnected(remotePort(downstream))
 	if err != nil {
 		log.Println(err)
 	}
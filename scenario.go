@@ -0,0 +1,178 @@
+package stadis
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Operations of a scenario step.
+const (
+	OpNodeState  = "nodeState"  //set the state of node 'Name' to 'NodeState'.
+	OpLink       = "link"       //add or update 'Link'.
+	OpRemoveLink = "removeLink" //remove the link between 'Link.From' and 'Link.To'.
+	OpStartProxy = "startProxy" //start 'Proxy'.
+	OpStopProxy  = "stopProxy"  //stop the proxy on 'Proxy.ProxyPort'.
+	OpSnapshot   = "snapshot"   //save the node and link states as snapshot 'Name'.
+	OpRestore    = "restore"    //restore the node and link states from snapshot 'Name'.
+)
+
+//Scenario is a schedule of faults described once and replayed in many tests, e.g.
+//	{"Steps":[
+//		{"At":5000000000,"Op":"link","Link":{"From":"animal","To":"plant","Down":true}},
+//		{"At":20000000000,"Op":"removeLink","Link":{"From":"animal","To":"plant"}},
+//		{"At":25000000000,"Op":"nodeState","Name":"animal.air.eagle","NodeState":{"Latency":500000000}}
+//	]}
+type Scenario struct {
+	Steps []*Step
+}
+
+type Step struct {
+	At        time.Duration //the time offset from the start of the scenario.
+	Op        string
+	Name      string
+	NodeState *NodeState
+	Link      *Link
+	Proxy     *Proxy
+}
+
+//ScenarioStatus is the progress of the last scenario started in a namespace.
+type ScenarioStatus struct {
+	Running bool
+	Done    int //the number of steps executed.
+	Total   int
+	Err     string `json:",omitempty"` //the error of the failed step, the scenario stops at the first failure.
+}
+
+type scenarioRunner struct {
+	mu     sync.Mutex
+	status ScenarioStatus
+	stopCh chan struct{}
+}
+
+func (step *Step) validate() (err error) {
+	switch step.Op {
+	case OpNodeState:
+		if step.Name == "" || step.NodeState == nil {
+			err = errors.New("'Name' and 'NodeState' required by " + step.Op)
+		}
+	case OpLink, OpRemoveLink:
+		if step.Link == nil {
+			err = errors.New("'Link' required by " + step.Op)
+		}
+	case OpStartProxy, OpStopProxy:
+		if step.Proxy == nil {
+			err = errors.New("'Proxy' required by " + step.Op)
+		}
+	case OpSnapshot, OpRestore:
+		if step.Name == "" {
+			err = errors.New("'Name' required by " + step.Op)
+		}
+	default:
+		err = errors.New("unknown scenario operation " + step.Op)
+	}
+	return
+}
+
+//execute the step in the namespace.
+func (ns *namespace) runStep(step *Step) error {
+	topo := ns.topology()
+	switch step.Op {
+	case OpNodeState:
+		return topo.setNodeState(step.Name, *step.NodeState)
+	case OpLink:
+		return topo.setLink(*step.Link)
+	case OpRemoveLink:
+		return topo.removeLink(step.Link.From, step.Link.To)
+	case OpStartProxy:
+		p := step.Proxy
+		return ns.startProxy(p.ClientName, p.ProxyName, p.ProxyPort, p.OriginAddr)
+	case OpStopProxy:
+		return ns.stopProxy(step.Proxy.ProxyPort)
+	case OpSnapshot:
+		return topo.saveSnapshot(step.Name)
+	case OpRestore:
+		return topo.restoreSnapshot(step.Name)
+	}
+	return nil
+}
+
+//start the scenario in background, only one scenario can run in a namespace at a time.
+func (ns *namespace) startScenario(scenario *Scenario) (err error) {
+	for _, step := range scenario.Steps {
+		err = step.validate()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	steps := make([]*Step, len(scenario.Steps))
+	copy(steps, scenario.Steps)
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].At < steps[j].At })
+	runner := &ns.scenario
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if runner.status.Running {
+		err = errors.New("a scenario is running")
+		log.Println(err)
+		return
+	}
+	runner.status = ScenarioStatus{Running: true, Total: len(steps)}
+	runner.stopCh = make(chan struct{})
+	go ns.runScenario(steps, runner.stopCh)
+	return
+}
+
+func (ns *namespace) runScenario(steps []*Step, stopCh chan struct{}) {
+	runner := &ns.scenario
+	start := time.Now()
+	for _, step := range steps {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(time.Until(start.Add(step.At))):
+		}
+		err := ns.runStep(step)
+		runner.mu.Lock()
+		if runner.stopCh != stopCh || !runner.status.Running {
+			//stopped while running the step, the status may belong to a new scenario now.
+			runner.mu.Unlock()
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			runner.status.Err = err.Error()
+			runner.status.Running = false
+			runner.mu.Unlock()
+			return
+		}
+		runner.status.Done++
+		runner.mu.Unlock()
+	}
+	runner.mu.Lock()
+	if runner.stopCh == stopCh {
+		runner.status.Running = false
+	}
+	runner.mu.Unlock()
+}
+
+//stop the running scenario, the steps executed are not reverted.
+func (ns *namespace) stopScenario() {
+	runner := &ns.scenario
+	runner.mu.Lock()
+	if runner.status.Running {
+		close(runner.stopCh)
+		runner.status.Running = false
+	}
+	runner.mu.Unlock()
+}
+
+func (ns *namespace) scenarioStatus() (status ScenarioStatus) {
+	runner := &ns.scenario
+	runner.mu.Lock()
+	status = runner.status
+	runner.mu.Unlock()
+	return
+}
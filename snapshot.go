@@ -0,0 +1,148 @@
+package stadis
+
+import (
+	"errors"
+	"log"
+	"sort"
+)
+
+//snapshot holds the states of all the nodes and links, ports are not included,
+//so restoring a snapshot doesn't break the open connections.
+type snapshot struct {
+	nodeStates map[string]NodeState //node full name to state
+	links      map[linkKey]Link
+}
+
+//drop the states and links of the removed node and its children, so restoring the snapshot
+//never brings back a link to a node that doesn't exist.
+func (snap *snapshot) removeNode(nodeName string) {
+	for name := range snap.nodeStates {
+		if containsNode(nodeName, name) {
+			delete(snap.nodeStates, name)
+		}
+	}
+	for key, link := range snap.links {
+		if containsNode(nodeName, link.From) || containsNode(nodeName, link.To) {
+			delete(snap.links, key)
+		}
+	}
+}
+
+//call fn for every data center, rack and host in the topology.
+func (topo *topology) eachNode(fn func(nod node)) {
+	for _, dc := range topo.dataCenterMap {
+		fn(dc)
+		for _, rack := range dc.rackMap {
+			fn(rack)
+			for _, host := range rack.hostMap {
+				fn(host)
+			}
+		}
+	}
+}
+
+//setState keeps the old latency for zero, a saved state should be restored exactly.
+func resetState(nod node, state NodeState) {
+	switch n := nod.(type) {
+	case *dataCenter:
+		n.NodeState = state
+	case *rack:
+		n.NodeState = state
+	case *host:
+		n.NodeState = state
+	}
+}
+
+//set the node state exactly and notify the blocking requests.
+func (topo *topology) resetNodeState(nodeName string, state NodeState) (err error) {
+	topo.mutex.Lock()
+	defer topo.mutex.Unlock()
+	nod, err := topo.lookup(nodeName)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	resetState(nod, state)
+	topo.events.publish(Event{Type: EventNodeState, Name: nodeName, NodeState: &state})
+	topo.notifyUpdate()
+	return
+}
+
+//the full names of all the nodes, sorted so a seeded random choice is repeatable.
+func (topo *topology) nodeNames() (names []string) {
+	topo.mutex.RLock()
+	defer topo.mutex.RUnlock()
+	topo.eachNode(func(nod node) {
+		names = append(names, nod.fullName())
+	})
+	sort.Strings(names)
+	return
+}
+
+//save the current node and link states as a named snapshot, an existing one with the same name is replaced.
+func (topo *topology) saveSnapshot(name string) (err error) {
+	if name == "" {
+		err = errors.New("snapshot name required")
+		log.Println(err)
+		return
+	}
+	topo.mutex.Lock()
+	defer topo.mutex.Unlock()
+	snap := &snapshot{nodeStates: make(map[string]NodeState), links: make(map[linkKey]Link)}
+	topo.eachNode(func(nod node) {
+		snap.nodeStates[nod.fullName()] = nod.state()
+	})
+	for key, link := range topo.links {
+		snap.links[key] = *link
+	}
+	topo.snapshots[name] = snap
+	return
+}
+
+//restore the node and link states from the snapshot, the blocking requests are notified once.
+//Nodes created after the snapshot keep their current states, links not in the snapshot are removed,
+//links of the nodes not in the topology any more are not restored.
+func (topo *topology) restoreSnapshot(name string) (err error) {
+	topo.mutex.Lock()
+	defer topo.mutex.Unlock()
+	snap := topo.snapshots[name]
+	if snap == nil {
+		err = errors.New("snapshot not found")
+		log.Println(err)
+		return
+	}
+	topo.eachNode(func(nod node) {
+		state, ok := snap.nodeStates[nod.fullName()]
+		if !ok {
+			return
+		}
+		resetState(nod, state)
+	})
+	topo.links = make(map[linkKey]*Link)
+	for key, link := range snap.links {
+		//the snapshot can be taken before a merged config without the node.
+		if _, err := topo.lookup(link.From); err != nil {
+			continue
+		}
+		if _, err := topo.lookup(link.To); err != nil {
+			continue
+		}
+		l := link
+		topo.links[key] = &l
+	}
+	topo.events.publish(Event{Type: EventRestore, Name: name})
+	topo.notifyUpdate()
+	return
+}
+
+func (topo *topology) deleteSnapshot(name string) (err error) {
+	topo.mutex.Lock()
+	defer topo.mutex.Unlock()
+	if topo.snapshots[name] == nil {
+		err = errors.New("snapshot not found")
+		log.Println(err)
+		return
+	}
+	delete(topo.snapshots, name)
+	return
+}
@@ -1,12 +1,24 @@
 package stadis
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -45,7 +57,7 @@ func TestApi(t *testing.T) {
 	Cli.ServerStarted(lionHostName, lionPort)
 
 	appleDialLion, _ := Cli.DialState(appleHostName, lionPort)
-	expectedState := ConnState{
+	expectedState := DialState{
 		Latency: 3 * time.Minute,
 	}
 	if expectedState != appleDialLion {
@@ -57,7 +69,7 @@ func TestApi(t *testing.T) {
 
 	appleDialApple, _ := Cli.DialState(appleHostName, applePort)
 
-	expectedState = ConnState{
+	expectedState = DialState{
 		OK:      true,
 		Latency: 0,
 	}
@@ -72,7 +84,7 @@ func TestApi(t *testing.T) {
 
 	appleDialTiger, _ := Cli.DialState(appleHostName, tigerPort)
 
-	expectedState = ConnState{
+	expectedState = DialState{
 		OK:      true,
 		Latency: 2 * (1 + 10 + 100 + 100 + 10 + 1) * time.Millisecond,
 	}
@@ -85,7 +97,7 @@ func TestApi(t *testing.T) {
 	Cli.UpdateNodeState(appleHostName, NodeState{Latency: 30 * time.Millisecond})
 	appleDialTiger, _ = Cli.DialState(appleHostName, tigerPort)
 
-	expectedState = ConnState{
+	expectedState = DialState{
 		OK:      true,
 		Latency: 2 * (30 + 10 + 100 + 100 + 10 + 1) * time.Millisecond,
 	}
@@ -96,7 +108,7 @@ func TestApi(t *testing.T) {
 	Cli.UpdateNodeState("plant.fruit", NodeState{ExternalDown: true})
 	appleDialTiger, _ = Cli.DialState(appleHostName, tigerPort)
 
-	expectedState = ConnState{
+	expectedState = DialState{
 		OK:      false,
 		Latency: 3 * time.Minute,
 	}
@@ -186,7 +198,7 @@ func TestApi(t *testing.T) {
 		t.Fatal(err)
 	}
 	appleDialTiger, _ = Cli.DialState(appleHostName, tigerPort)
-	expectedState = ConnState{
+	expectedState = DialState{
 		OK:      false,
 		Latency: 2 * (30 + 10 + 100 + 100 + 10 + 1) * time.Millisecond,
 	}
@@ -196,6 +208,1591 @@ func TestApi(t *testing.T) {
 	}
 }
 
+func TestLink(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tigerPort := "30021"
+	Cli.ServerStarted(tigerHostName, tigerPort)
+
+	err = Cli.UpdateLink(Link{From: "plant.fruit", To: "animal", Latency: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appleDialTiger, _ := Cli.DialState(appleHostName, tigerPort)
+	expectedState := DialState{
+		OK:      true,
+		Latency: 2 * (1 + 50 + 10 + 1) * time.Millisecond,
+	}
+	if appleDialTiger != expectedState {
+		defaultServer.DumpNode("")
+		t.Fatal("link should replace the path above its ends, expected", expectedState, "actual", appleDialTiger)
+	}
+
+	//the more specific link wins.
+	Cli.UpdateLink(Link{From: "animal.land", To: appleHostName, Latency: 20 * time.Millisecond, Down: true})
+	appleDialTiger, _ = Cli.DialState(appleHostName, tigerPort)
+	expectedState = DialState{
+		OK:      false,
+		Latency: 3 * time.Minute,
+	}
+	if appleDialTiger != expectedState {
+		t.Fatal("wrong state for apple dial tiger, expected", expectedState, "actual", appleDialTiger)
+	}
+
+	//the link is bidirectional.
+	link, err := Cli.Link(appleHostName, "animal.land")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !link.Down || link.Latency != 20*time.Millisecond {
+		t.Fatal("wrong link", link)
+	}
+	links, _ := Cli.Links()
+	if len(links) != 2 {
+		t.Fatal("expected 2 links, actual", links)
+	}
+
+	err = Cli.UpdateLink(Link{From: "animal", To: "animal.land"})
+	if err == nil {
+		t.Fatal("link between a node and its descendant should be refused.")
+	}
+
+	Cli.RemoveLink("animal.land", appleHostName)
+	Cli.RemoveLink("animal", "plant.fruit")
+	appleDialTiger, _ = Cli.DialState(appleHostName, tigerPort)
+	expectedState = DialState{
+		OK:      true,
+		Latency: 2 * (1 + 10 + 100 + 100 + 10 + 1) * time.Millisecond,
+	}
+	if appleDialTiger != expectedState {
+		t.Fatal("removed link should not affect state, expected", expectedState, "actual", appleDialTiger)
+	}
+}
+
+func TestLinkTie(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applePort := "30022"
+	Cli.ServerStarted(appleHostName, applePort)
+	//both links have the same depth, the one with the deeper end wins.
+	Cli.UpdateLink(Link{From: tigerHostName, To: "plant", Latency: 300 * time.Millisecond})
+	Cli.UpdateLink(Link{From: "animal.land", To: "plant.fruit", Latency: 30 * time.Millisecond})
+	expectedState := DialState{
+		OK:      true,
+		Latency: 2 * (300 + 10 + 1) * time.Millisecond,
+	}
+	for i := 0; i < 100; i++ {
+		tigerDialApple, err := Cli.DialState(tigerHostName, applePort)
+		if err != nil || tigerDialApple != expectedState {
+			t.Fatal("expected", expectedState, "actual", tigerDialApple, err)
+		}
+	}
+}
+
+func TestOneWayPartition(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applePort := "30031"
+	appleListener, err := Listen("tcp", "localhost:"+applePort, appleHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer appleListener.Close()
+	received := make(chan []byte, 10)
+	go func() {
+		conn, err := appleListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			buf := make([]byte, 4096)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- buf[:n]
+			conn.Write(buf[:n])
+		}
+	}()
+	tigerConn, err := NewDialFunc(tigerHostName, 0)("tcp", "localhost:"+applePort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tigerConn.Close()
+
+	//apple can not send to tiger, but tiger can send to apple.
+	err = Cli.UpdateLink(Link{From: "plant", To: "animal.land", Down: true, OneWay: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, _ := Cli.ConnState(localPort(tigerConn), applePort, nil)
+	if !state.Send.OK || state.Recv.OK {
+		t.Fatal("only the receive direction should be down, actual", state)
+	}
+	dialState, _ := Cli.DialState(tigerHostName, applePort)
+	if dialState.OK {
+		t.Fatal("dial should fail when one direction is down")
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	tigerConn.Write([]byte("ping"))
+	select {
+	case data := <-received:
+		if string(data) != "ping" {
+			t.Fatal("wrong data received", string(data))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("apple should receive data from tiger")
+	}
+	tigerConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = tigerConn.Read(make([]byte, 4096))
+	if err == nil {
+		t.Fatal("tiger should not receive the reply from apple")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tigerPort := "30041"
+	Cli.ServerStarted(tigerHostName, tigerPort)
+	Cli.UpdateNodeState(appleHostName, NodeState{Jitter: 5 * time.Millisecond, Distribution: NormalDistribution})
+	Cli.UpdateNodeState("animal", NodeState{Jitter: 20 * time.Millisecond, Distribution: ParetoDistribution})
+	err = Cli.UpdateNodeState("animal.land", NodeState{Jitter: time.Millisecond, Distribution: "poisson"})
+	if err == nil {
+		t.Fatal("unknown distribution should be refused")
+	}
+	appleDialTiger, _ := Cli.DialState(appleHostName, tigerPort)
+	expectedState := DialState{
+		OK:           true,
+		Latency:      2 * (1 + 10 + 100 + 100 + 10 + 1) * time.Millisecond,
+		Jitter:       2 * 25 * time.Millisecond,
+		Distribution: ParetoDistribution,
+	}
+	if appleDialTiger != expectedState {
+		t.Fatal("wrong state for apple dial tiger, expected", expectedState, "actual", appleDialTiger)
+	}
+
+	for _, distribution := range []string{UniformDistribution, NormalDistribution, ParetoDistribution} {
+		SetRandSeed(42)
+		first := newRand()
+		SetRandSeed(42)
+		second := newRand()
+		for i := 0; i < 1000; i++ {
+			delta := sampleJitter(first, 10*time.Millisecond, 20*time.Millisecond, distribution)
+			if delta != sampleJitter(second, 10*time.Millisecond, 20*time.Millisecond, distribution) {
+				t.Fatal("jitter should be repeatable with the same seed")
+			}
+			if delta < -10*time.Millisecond {
+				t.Fatal("latency should never be negative")
+			}
+			if distribution == UniformDistribution && delta > 20*time.Millisecond {
+				t.Fatal("uniform jitter out of range", delta)
+			}
+			if distribution == ParetoDistribution && delta < 0 {
+				t.Fatal("pareto jitter should never be negative", delta)
+			}
+		}
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lionPort := "30051"
+	lionListener, err := Listen("tcp", "localhost:"+lionPort, lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lionListener.Close()
+	go echoServe(lionListener)
+	Cli.UpdateNodeState(tigerHostName, NodeState{Bandwidth: 100 * 1024})
+	Cli.UpdateNodeState("animal.land", NodeState{Bandwidth: 10 * 1024})
+
+	dialFunc := NewDialFunc(tigerHostName, 0)
+	//two connections share the bandwidth of tiger's uplink, rack's bandwidth is not involved.
+	done := make(chan error)
+	before := time.Now()
+	for i := 0; i < 2; i++ {
+		go func() {
+			conn, err := dialFunc("tcp", "localhost:"+lionPort)
+			if err != nil {
+				done <- err
+				return
+			}
+			defer conn.Close()
+			state, _ := Cli.ConnState(localPort(conn), lionPort, nil)
+			if state.Send.Bottleneck() != (Uplink{Name: tigerHostName + "/out", Bandwidth: 100 * 1024}) {
+				done <- fmt.Errorf("wrong send state %v", state.Send)
+				return
+			}
+			data := make([]byte, 50*1024)
+			go conn.Write(data)
+			_, err = io.ReadFull(conn, data)
+			done <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	duration := time.Now().Sub(before)
+	if duration < 800*time.Millisecond || duration > 2*time.Second {
+		t.Fatal("expected about 1s to transfer 100KB at 100KB/s, actual", duration)
+	}
+
+	//the connections from tiger and lion share the bandwidth of the rack's uplink besides their own.
+	eaglePort := "30052"
+	eagleListener, err := Listen("tcp", "localhost:"+eaglePort, "animal.air.eagle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eagleListener.Close()
+	go echoServe(eagleListener)
+	Cli.UpdateNodeState(lionHostName, NodeState{Bandwidth: 100 * 1024})
+	Cli.UpdateNodeState("animal.land", NodeState{Bandwidth: 100 * 1024})
+	before = time.Now()
+	for _, name := range []string{tigerHostName, lionHostName} {
+		go func(name string) {
+			conn, err := NewDialFunc(name, 0)("tcp", "localhost:"+eaglePort)
+			if err != nil {
+				done <- err
+				return
+			}
+			defer conn.Close()
+			data := make([]byte, 50*1024)
+			go conn.Write(data)
+			_, err = io.ReadFull(conn, data)
+			done <- err
+		}(name)
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	duration = time.Now().Sub(before)
+	if duration < 800*time.Millisecond || duration > 2*time.Second {
+		t.Fatal("expected about 1s to transfer 100KB through the rack at 100KB/s, actual", duration)
+	}
+}
+
+func TestBandwidthIsolation(t *testing.T) {
+	//the networks don't share the bandwidth of the uplinks with the same names.
+	done := make(chan error)
+	before := time.Now()
+	for _, port := range []string{"30053", "30054"} {
+		network := NewNetwork()
+		network.UpdateNodeState(tigerHostName, NodeState{Bandwidth: 100 * 1024})
+		lionListener, err := network.Listen("tcp", "localhost:"+port, lionHostName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lionListener.Close()
+		go echoServe(lionListener)
+		go func(network *Network, port string) {
+			conn, err := network.Dialer(tigerHostName, 0).Dial("tcp", "localhost:"+port)
+			if err != nil {
+				done <- err
+				return
+			}
+			defer conn.Close()
+			data := make([]byte, 50*1024)
+			go conn.Write(data)
+			_, err = io.ReadFull(conn, data)
+			done <- err
+		}(network, port)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if duration := time.Now().Sub(before); duration < 400*time.Millisecond || duration > 800*time.Millisecond {
+		t.Fatal("expected about 500ms to transfer 50KB at 100KB/s in each network, actual", duration)
+	}
+
+	//the clients of an API server take the bandwidth on the server, like the ones in other processes,
+	//so they share it with the connections of the embedded network.
+	network := NewNetwork()
+	network.UpdateNodeState(tigerHostName, NodeState{Bandwidth: 100 * 1024})
+	ts := httptest.NewServer(NewNetworkApiServer(network))
+	defer ts.Close()
+	cli := &ApiClient{ApiAddr: ts.Listener.Addr().String()}
+	lionListener, err := network.Listen("tcp", "localhost:30055", lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lionListener.Close()
+	go echoServe(lionListener)
+	before = time.Now()
+	for _, backend := range []Backend{network, cli} {
+		go func(backend Backend) {
+			conn, err := (&Dialer{ClientName: tigerHostName, Backend: backend}).Dial("tcp", "localhost:30055")
+			if err != nil {
+				done <- err
+				return
+			}
+			defer conn.Close()
+			data := make([]byte, 50*1024)
+			go conn.Write(data)
+			_, err = io.ReadFull(conn, data)
+			done <- err
+		}(backend)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if duration := time.Now().Sub(before); duration < 900*time.Millisecond || duration > 1500*time.Millisecond {
+		t.Fatal("expected about 1s to transfer 100KB at 100KB/s in the shared network, actual", duration)
+	}
+}
+
+func TestLossRate(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tigerPort := "30061"
+	Cli.ServerStarted(tigerHostName, tigerPort)
+	Cli.UpdateNodeState("plant", NodeState{LossRate: 0.1})
+	Cli.UpdateNodeState("animal", NodeState{LossRate: 0.2})
+	err = Cli.UpdateNodeState("animal.land", NodeState{LossRate: 1.5})
+	if err == nil {
+		t.Fatal("loss rate larger than 1 should be refused")
+	}
+	appleDialTiger, _ := Cli.DialState(appleHostName, tigerPort)
+	//each direction loses 28% of the packets.
+	expectedLossRate := 1 - 0.72*0.72
+	if math.Abs(appleDialTiger.LossRate-expectedLossRate) > 1e-9 {
+		t.Fatal("expected loss rate", expectedLossRate, "actual", appleDialTiger.LossRate)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	if delay := retransmitDelay(r, 0, time.Second); delay != 0 {
+		t.Fatal("no retransmission expected, actual delay", delay)
+	}
+	//the timeout doubles after each retransmission until it reaches the max.
+	expectedDelay := (1+2+4+8+16+32+64)*time.Second + 8*maxRTO
+	if delay := retransmitDelay(r, 1, time.Second); delay != expectedDelay {
+		t.Fatal("expected delay", expectedDelay, "actual", delay)
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(ttl time.Duration) {
+		PacketStateTTL = ttl
+	}(PacketStateTTL)
+	PacketStateTTL = 0
+	appleConn, err := ListenPacket("udp", "localhost:30071", appleHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer appleConn.Close()
+	tigerConn, err := ListenPacket("udp", "localhost:30072", tigerHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tigerConn.Close()
+	received := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := appleConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+		}
+	}()
+	expectReceived := func(expected int) {
+		count := 0
+		timeout := time.After(400 * time.Millisecond)
+		for {
+			select {
+			case <-received:
+				count++
+			case <-timeout:
+				if count != expected {
+					t.Fatal("expected", expected, "datagrams, actual", count)
+				}
+				return
+			}
+		}
+	}
+
+	before := time.Now()
+	tigerConn.WriteTo([]byte("hello"), appleConn.LocalAddr())
+	select {
+	case data := <-received:
+		duration := time.Now().Sub(before)
+		if data != "hello" || duration < 222*time.Millisecond || duration > 300*time.Millisecond {
+			t.Fatal("expected hello after 222ms, actual", data, duration)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("datagram should be received")
+	}
+
+	Cli.UpdateNodeState(tigerHostName, NodeState{DupRate: 1})
+	for i := 0; i < 3; i++ {
+		tigerConn.WriteTo([]byte("dup"), appleConn.LocalAddr())
+	}
+	expectReceived(6)
+
+	Cli.UpdateNodeState(tigerHostName, NodeState{LossRate: 1})
+	tigerConn.WriteTo([]byte("lost"), appleConn.LocalAddr())
+	expectReceived(0)
+
+	Cli.UpdateNodeState(tigerHostName, NodeState{ExternalDown: true})
+	tigerConn.WriteTo([]byte("down"), appleConn.LocalAddr())
+	expectReceived(0)
+
+	//the cached state is dropped as soon as the topology is changed, without waiting for the TTL.
+	PacketStateTTL = time.Minute
+	Cli.UpdateNodeState(tigerHostName, NodeState{})
+	tigerConn.WriteTo([]byte("up"), appleConn.LocalAddr())
+	expectReceived(1)
+	Cli.UpdateNodeState(tigerHostName, NodeState{ExternalDown: true})
+	time.Sleep(10 * time.Millisecond)
+	tigerConn.WriteTo([]byte("down"), appleConn.LocalAddr())
+	expectReceived(0)
+
+	err = tigerConn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tigerConn.WriteTo([]byte("closed"), appleConn.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("write after close should fail", err)
+	}
+	if err = tigerConn.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("second close should fail", err)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applePort := "30081"
+	appleListener, err := Listen("tcp", "localhost:"+applePort, appleHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer appleListener.Close()
+	go echoServe(appleListener)
+	dialer := &Dialer{ClientName: tigerHostName}
+
+	//the dial latency from tiger to apple is 444ms.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	before := time.Now()
+	_, err = dialer.DialContext(ctx, "tcp", "localhost:"+applePort)
+	if !errors.Is(err, context.Canceled) || time.Now().Sub(before) > 200*time.Millisecond {
+		t.Fatal("dial should be canceled soon, actual", err, time.Now().Sub(before))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = dialer.DialContext(ctx, "tcp", "localhost:"+applePort)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("dial should exceed the deadline, actual", err)
+	}
+
+	dialer.Timeout = 100 * time.Millisecond
+	_, err = dialer.Dial("tcp", "localhost:"+applePort)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatal("dial should time out, actual", err)
+	}
+
+	dialer.Timeout = 0
+	conn, err := dialer.DialContext(context.Background(), "tcp", "localhost:"+applePort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestConnErrors(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lionPort := "30091"
+	lionListener, err := Listen("tcp", "localhost:"+lionPort, lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lionListener.Close()
+	go echoServe(lionListener)
+	conn, err := NewDialFunc(tigerHostName, 0)("tcp", "localhost:"+lionPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 10))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("read should exceed the deadline, actual", err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	_, err = conn.Write(make([]byte, 10))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("write should exceed the deadline, actual", err)
+	}
+
+	//the packet being delayed when the read deadline exceeds is kept for the next read,
+	//and a packet longer than the read buffer is read in parts.
+	lionState, _ := Cli.NodeState(lionHostName)
+	Cli.UpdateNodeState(lionHostName, NodeState{Latency: 100 * time.Millisecond})
+	delayedConn, err := NewDialFunc(tigerHostName, 0)("tcp", "localhost:"+lionPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delayedConn.Close()
+	delayedConn.Write([]byte("0123456789"))
+	//the echo arrives after the send latency, but is delayed by the receive latency.
+	time.Sleep(120 * time.Millisecond)
+	delayedConn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 4)
+	if _, err = delayedConn.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("read should exceed the deadline, actual", err)
+	}
+	delayedConn.SetReadDeadline(time.Now().Add(time.Second))
+	var parts []string
+	for _, expected := range []string{"0123", "4567", "89"} {
+		n, err := delayedConn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, string(buf[:n]))
+		if string(buf[:n]) != expected {
+			t.Fatal("expected", expected, "actual", parts)
+		}
+	}
+	Cli.UpdateNodeState(lionHostName, lionState)
+
+	conn.Close()
+	_, err = conn.Read(make([]byte, 10))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatal("read closed connection should return net.ErrClosed, actual", err)
+	}
+	_, err = conn.Write(make([]byte, 10))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatal("write closed connection should return net.ErrClosed, actual", err)
+	}
+	if err = conn.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("close twice should return net.ErrClosed, actual", err)
+	}
+
+	//read and write time out after the network is down.
+	defer func(timeOut time.Duration) {
+		tcpTimeOut = timeOut
+	}(tcpTimeOut)
+	tcpTimeOut = 100 * time.Millisecond
+	downConn, err := NewDialFunc(tigerHostName, 0)("tcp", "localhost:"+lionPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downConn.Close()
+	downConn.Write([]byte("ping"))
+	//wait for the echo to arrive before the network is down.
+	time.Sleep(50 * time.Millisecond)
+	Cli.UpdateNodeState(lionHostName, NodeState{ExternalDown: true})
+	time.Sleep(10 * time.Millisecond)
+	isTimedOut := func(err error, op string) bool {
+		opErr, ok := err.(*net.OpError)
+		return ok && opErr.Op == op && errors.Is(err, syscall.ETIMEDOUT)
+	}
+	if _, err = downConn.Read(make([]byte, 10)); !isTimedOut(err, "read") {
+		t.Fatal("read should time out, actual", err)
+	}
+	//the error of a written packet is returned by a later write.
+	err = nil
+	for i := 0; i < 20 && err == nil; i++ {
+		_, err = downConn.Write([]byte("ping"))
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !isTimedOut(err, "write") {
+		t.Fatal("write should time out, actual", err)
+	}
+
+	_, err = (&Dialer{ClientName: tigerHostName, Timeout: time.Second}).Dial("tcp", "localhost:"+lionPort)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("dial unreachable host should time out, actual", err)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	network := NewNetwork()
+	lionListener, err := network.Listen("tcp", "localhost:30101", lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lionListener.Close()
+	go echoServe(lionListener)
+	//the API server doesn't know the embedded network.
+	_, err = Cli.DialState(tigerHostName, "30101")
+	if err == nil {
+		t.Fatal("server port should be registered in the embedded network only")
+	}
+	conn, err := network.Dialer(tigerHostName, 0).Dial("tcp", "localhost:30101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip := func() time.Duration {
+		before := time.Now()
+		buf := []byte("ping")
+		conn.Write(buf)
+		_, err := io.ReadFull(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Now().Sub(before)
+	}
+	if duration := roundTrip(); duration < 4*time.Millisecond || duration > 50*time.Millisecond {
+		t.Fatal("expected round trip 4ms, actual", duration)
+	}
+	network.UpdateNodeState(lionHostName, NodeState{Latency: 100 * time.Millisecond})
+	time.Sleep(10 * time.Millisecond)
+	if duration := roundTrip(); duration < 202*time.Millisecond || duration > 300*time.Millisecond {
+		t.Fatal("expected round trip 202ms, actual", duration)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Cli.CreateNamespace("ns1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Cli.DeleteNamespace("ns1")
+	if err = Cli.CreateNamespace("ns1", nil); err == nil {
+		t.Fatal("namespace should exist already")
+	}
+	names, err := Cli.Namespaces()
+	if err != nil || len(names) != 1 || names[0] != "ns1" {
+		t.Fatal(names, err)
+	}
+	nsCli := Cli.WithNamespace("ns1")
+	if Cli.WithNamespace("ns1") != nsCli || nsCli.watcher() != Cli.WithNamespace("ns1").watcher() {
+		t.Fatal("the clients of the same namespace should share the watcher")
+	}
+	err = nsCli.UpdateNodeState(lionHostName, NodeState{Latency: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeState, err := Cli.NodeState(lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeState.Latency != time.Millisecond {
+		t.Fatal("node state in default namespace should not be changed, actual", nodeState.Latency)
+	}
+	lionListener, err := nsCli.Listen("tcp", "localhost:30111", lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lionListener.Close()
+	go echoServe(lionListener)
+	//the default namespace doesn't know the port.
+	_, err = Cli.DialState(tigerHostName, "30111")
+	if err == nil {
+		t.Fatal("server port should be registered in the namespace only")
+	}
+	conn, err := nsCli.Dialer(tigerHostName, 0).Dial("tcp", "localhost:30111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	before := time.Now()
+	buf := []byte("ping")
+	conn.Write(buf)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration := time.Now().Sub(before); duration < 202*time.Millisecond || duration > 300*time.Millisecond {
+		t.Fatal("expected round trip 202ms, actual", duration)
+	}
+	err = Cli.DeleteNamespace("ns1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = nsCli.NodeState(lionHostName)
+	if err == nil {
+		t.Fatal("namespace should be deleted")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Cli.UpdateNodeState(lionHostName, NodeState{Latency: 50 * time.Millisecond, ExternalDown: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Cli.UpdateLink(Link{From: "animal", To: "plant", Latency: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lionListener, err := Listen("tcp", "localhost:30121", lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lionListener.Close()
+	config, err := Cli.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//load the exported config into a new network.
+	network := NewNetwork()
+	err = network.UpdateConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeState, err := network.NodeState(lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeState.Latency != 50*time.Millisecond || !nodeState.ExternalDown {
+		t.Fatal("node state not exported", nodeState)
+	}
+	link, err := network.Link("animal", "plant")
+	if err != nil || link.Latency != 300*time.Millisecond {
+		t.Fatal(link, err)
+	}
+	_, err = network.DialState(tigerHostName, "30121")
+	if err != nil {
+		t.Fatal("server port should be exported", err)
+	}
+	exported, _ := network.Config()
+	data2, _ := json.Marshal(exported)
+	if !bytes.Equal(data, data2) {
+		t.Fatal("config should be the same after loaded")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lionListener, err := Listen("tcp", "localhost:30131", lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lionListener.Close()
+	go echoServe(lionListener)
+	conn, err := NewDialFunc(tigerHostName, 0)("tcp", "localhost:30131")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = Cli.Snapshot("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Cli.DeleteSnapshot("base")
+	Cli.UpdateNodeState(lionHostName, NodeState{Latency: 100 * time.Millisecond})
+	Cli.UpdateNodeState("animal.land.wolf", NodeState{ExternalDown: true})
+	Cli.UpdateLink(Link{From: "animal", To: "plant", Down: true})
+	err = Cli.Restore("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeState, _ := Cli.NodeState(lionHostName)
+	if nodeState.Latency != time.Millisecond {
+		t.Fatal("node state not restored", nodeState)
+	}
+	nodeState, _ = Cli.NodeState("animal.land.wolf")
+	if nodeState.ExternalDown {
+		t.Fatal("node state not restored", nodeState)
+	}
+	links, _ := Cli.Links()
+	if len(links) != 0 {
+		t.Fatal("link should be removed", links)
+	}
+	//the port registration is kept, so the open connection gets the restored state.
+	time.Sleep(10 * time.Millisecond)
+	before := time.Now()
+	buf := []byte("ping")
+	conn.Write(buf)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration := time.Now().Sub(before); duration > 50*time.Millisecond {
+		t.Fatal("expected round trip 4ms, actual", duration)
+	}
+	if err = Cli.Restore("unknown"); err == nil {
+		t.Fatal("unknown snapshot should fail")
+	}
+}
+
+func TestAddRemoveNode(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	catHostName := "animal.land.cat"
+	lionListener, err := Listen("tcp", "localhost:30141", lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lionListener.Close()
+	go echoServe(lionListener)
+	if err = Cli.AddNode("animal.land.cat.kitten", nil); err == nil {
+		t.Fatal("invalid node name should fail")
+	}
+	if err = Cli.AddNode("animal.land", nil); err == nil {
+		t.Fatal("existing node should fail")
+	}
+	err = Cli.AddNode(catHostName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeState, err := Cli.NodeState(catHostName)
+	if err != nil || nodeState.Latency != time.Millisecond {
+		t.Fatal("host default state should be used", nodeState, err)
+	}
+	err = Cli.AddNode("moon", &NodeState{Latency: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Cli.AddNode("moon.crater", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the registered port is kept.
+	dialState, err := Cli.DialState(catHostName, "30141")
+	if err != nil || !dialState.OK {
+		t.Fatal(dialState, err)
+	}
+	conn, err := NewDialFunc(catHostName, 0)("tcp", "localhost:30141")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = Cli.RemoveNode("animal.land", false); err == nil {
+		t.Fatal("node with open ports should not be removed")
+	}
+	err = Cli.RemoveNode(catHostName, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	buf := []byte("ping")
+	conn.Write(buf)
+	_, err = io.ReadFull(conn, buf)
+	if err == nil {
+		t.Fatal("connection on removed node should fail")
+	}
+	err = Cli.UpdateLink(Link{From: "moon.crater", To: "animal", Latency: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Cli.Snapshot("moon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Cli.DeleteSnapshot("moon")
+	err = Cli.RemoveNode("moon", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Cli.NodeState("moon.crater"); err == nil {
+		t.Fatal("node should be removed")
+	}
+	//the snapshot doesn't bring back the link of the removed node, so the config can be loaded again.
+	err = Cli.Restore("moon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := Cli.Config()
+	if err != nil || len(config.Links) != 0 {
+		t.Fatal(config, err)
+	}
+	data, _ := json.Marshal(config)
+	err = Cli.UpdateConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lionListener, err := Listen("tcp", "localhost:30151", lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lionListener.Close()
+	go echoServe(lionListener)
+	conn, err := NewDialFunc(tigerHostName, 0)("tcp", "localhost:30151")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	config := bytes.Replace(DefaultConfig, []byte(`"HostDefault":{"Latency":1000000}`), []byte(`"HostDefault":{"Latency":50000000}`), 1)
+	err = Cli.MergeConfig(bytes.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	before := time.Now()
+	buf := []byte("ping")
+	conn.Write(buf)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration := time.Now().Sub(before); duration < 200*time.Millisecond || duration > 300*time.Millisecond {
+		t.Fatal("expected round trip 200ms, actual", duration)
+	}
+	//the port on the listener is still registered.
+	_, err = Cli.DialState(appleHostName, "30151")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a listener stopped before the merge doesn't leave its port on the host.
+	wolfListener, err := Listen("tcp", "localhost:30152", "animal.land.wolf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wolfListener.Close()
+	err = Cli.MergeConfig(bytes.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Cli.RemoveNode("animal.land.wolf", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigProxies(t *testing.T) {
+	originListener, err := net.Listen("tcp", "localhost:30221")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer originListener.Close()
+	go echoServe(originListener)
+	config := bytes.Replace(DefaultConfig, []byte(`"DataCenters"`),
+		[]byte(`"Proxies":[{"ClientName":"animal.land.tiger","ProxyName":"plant.fruit.apple","ProxyPort":"30222","OriginAddr":"localhost:30221"}],"DataCenters"`), 1)
+	err = Cli.CreateNamespace("proxies", bytes.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Cli.DeleteNamespace("proxies")
+	nsCli := Cli.WithNamespace("proxies")
+	proxies, err := nsCli.Proxies()
+	if err != nil || len(proxies) != 1 || proxies[0].ProxyPort != "30222" {
+		t.Fatal(proxies, err)
+	}
+	dialState, err := nsCli.DialState(tigerHostName, "30222")
+	if err != nil || !dialState.OK {
+		t.Fatal(dialState, err)
+	}
+	//the config with the proxies can be loaded again, the proxy is restarted.
+	exported, err := nsCli.Config()
+	if err != nil || len(exported.Proxies) != 1 || *exported.Proxies[0] != proxies[0] {
+		t.Fatal(exported, err)
+	}
+	data, _ := json.Marshal(exported)
+	err = nsCli.UpdateConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", "localhost:30222", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := []byte("ping")
+	conn.Write(buf)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Fatal(string(buf), err)
+	}
+	_, err = nsCli.DialState(tigerHostName, "30222")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPersistState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stadis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	network := NewNetwork()
+	server := NewNetworkApiServer(network)
+	err = server.PersistState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = network.UpdateNodeState(lionHostName, NodeState{Latency: 100 * time.Millisecond, ExternalDown: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = network.UpdateLink(Link{From: "animal", To: "plant", Latency: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.getNamespace("").startProxy(tigerHostName, appleHostName, "30231", "localhost:30232")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the client name updated by the API is saved too.
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("PUT", "/proxy?proxyPort=30231&clientName="+lionHostName, nil))
+	if recorder.Code != 200 {
+		t.Fatal(recorder.Code, recorder.Body)
+	}
+	time.Sleep(100 * time.Millisecond)
+	//restart the server.
+	server.getNamespace("").close()
+	network = NewNetwork()
+	server = NewNetworkApiServer(network)
+	err = server.PersistState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.getNamespace("").close()
+	nodeState, err := network.NodeState(lionHostName)
+	if err != nil || nodeState.Latency != 100*time.Millisecond || !nodeState.ExternalDown {
+		t.Fatal(nodeState, err)
+	}
+	link, err := network.Link("animal", "plant")
+	if err != nil || link.Latency != 300*time.Millisecond {
+		t.Fatal(link, err)
+	}
+	proxies := server.getNamespace("").sortedProxies()
+	if len(proxies) != 1 || *proxies[0].info() != (Proxy{lionHostName, appleHostName, "30231", "localhost:30232"}) {
+		t.Fatal(proxies)
+	}
+	_, err = network.DialState(tigerHostName, "30231")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScenario(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scenario := &Scenario{Steps: []*Step{
+		{At: 100 * time.Millisecond, Op: OpRemoveLink, Link: &Link{From: "animal", To: "plant"}},
+		{At: 0, Op: OpLink, Link: &Link{From: "animal", To: "plant", Down: true}},
+		{At: 100 * time.Millisecond, Op: OpNodeState, Name: "animal.air.eagle", NodeState: &NodeState{Latency: 500 * time.Millisecond}},
+	}}
+	before := time.Now()
+	err = Cli.RunScenario(scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration := time.Now().Sub(before); duration < 100*time.Millisecond {
+		t.Fatal("scenario should take 100ms, actual", duration)
+	}
+	links, _ := Cli.Links()
+	if len(links) != 0 {
+		t.Fatal("link should be removed", links)
+	}
+	nodeState, _ := Cli.NodeState("animal.air.eagle")
+	if nodeState.Latency != 500*time.Millisecond {
+		t.Fatal("node state not set", nodeState)
+	}
+	err = Cli.StartScenario(&Scenario{Steps: []*Step{{Op: "unknown"}}})
+	if err == nil {
+		t.Fatal("unknown operation should fail")
+	}
+	//the scenario stops at the failed step.
+	err = Cli.RunScenario(&Scenario{Steps: []*Step{{Op: OpRestore, Name: "unknown"}}})
+	if err == nil {
+		t.Fatal("failed step should fail the scenario")
+	}
+	err = Cli.StartScenario(&Scenario{Steps: []*Step{{At: time.Hour, Op: OpSnapshot, Name: "never"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Cli.StartScenario(scenario); err == nil {
+		t.Fatal("only one scenario can run at a time")
+	}
+	err = Cli.StopScenario()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := Cli.ScenarioStatus()
+	if err != nil || status.Running || status.Done != 0 {
+		t.Fatal(status, err)
+	}
+}
+
+func TestNemesis(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Cli.StartNemesis(Nemesis{Faults: []string{"unknown"}}); err == nil {
+		t.Fatal("unknown fault should fail")
+	}
+	if err = Cli.StartNemesis(Nemesis{Faults: []string{FaultLatency}, Interval: -time.Second}); err == nil {
+		t.Fatal("negative interval should fail")
+	}
+	//the nemesis skips the faults on an empty topology.
+	err = Cli.CreateNamespace("empty", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Cli.DeleteNamespace("empty")
+	emptyCli := Cli.WithNamespace("empty")
+	err = emptyCli.StartNemesis(Nemesis{Faults: []string{FaultPartition, FaultLatency}, Interval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	emptyCli.StopNemesis()
+	status, err := emptyCli.NemesisStatus()
+	if err != nil || len(status.Actions) < 3 || !strings.Contains(status.Actions[1], "skip") {
+		t.Fatal(status, err)
+	}
+	nemesis := Nemesis{
+		Seed:     1,
+		Faults:   []string{FaultInternalDown, FaultExternalDown, FaultLatency, FaultPartition},
+		Interval: 5 * time.Millisecond,
+		Duration: 5 * time.Millisecond,
+	}
+	err = Cli.StartNemesis(nemesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Cli.StartNemesis(nemesis); err == nil {
+		t.Fatal("only one nemesis can run at a time")
+	}
+	time.Sleep(200 * time.Millisecond)
+	err = Cli.StopNemesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err = Cli.NemesisStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Running || len(status.Actions) < 4 {
+		t.Fatal(status)
+	}
+	//all the faults are healed after stopped.
+	config, _ := Cli.Config()
+	for _, dc := range config.DataCenters {
+		if dc.InternalDown || dc.ExternalDown || dc.Latency != 100*time.Millisecond {
+			t.Fatal("not healed", dc.Name, *dc.NodeState)
+		}
+		for _, rack := range dc.Racks {
+			if rack.InternalDown || rack.ExternalDown || rack.Latency != 10*time.Millisecond {
+				t.Fatal("not healed", rack.Name, *rack.NodeState)
+			}
+			for _, host := range rack.Hosts {
+				if host.InternalDown || host.ExternalDown || host.Latency != time.Millisecond {
+					t.Fatal("not healed", host.Name, *host.NodeState)
+				}
+			}
+		}
+	}
+	if len(config.Links) != 0 {
+		t.Fatal("not healed", config.Links)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := Cli.Events(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitEvent := func(evType string) Event {
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == evType {
+					return ev
+				}
+			case <-timeout:
+				t.Fatal("event not received", evType)
+			}
+		}
+	}
+	Cli.UpdateNodeState(lionHostName, NodeState{Latency: 5 * time.Millisecond, ExternalDown: true})
+	ev := waitEvent(EventNodeState)
+	if ev.Name != lionHostName || ev.NodeState == nil || !ev.NodeState.ExternalDown {
+		t.Fatal(ev)
+	}
+	Cli.UpdateLink(Link{From: "animal", To: "plant", Down: true})
+	if ev = waitEvent(EventLinkSet); ev.Link == nil || !ev.Link.Down {
+		t.Fatal(ev)
+	}
+	lionListener, err := Listen("tcp", "localhost:30171", lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev = waitEvent(EventServerStarted); ev.Name != lionHostName || ev.Port != 30171 {
+		t.Fatal(ev)
+	}
+	lionListener.Close()
+	waitEvent(EventServerStopped)
+	Cli.StartProxy(tigerHostName, lionHostName, "30172", "localhost:30171")
+	if ev = waitEvent(EventProxyStarted); ev.Proxy == nil || ev.Proxy.ProxyPort != "30172" {
+		t.Fatal(ev)
+	}
+	Cli.StopProxy("30172")
+	waitEvent(EventProxyStopped)
+	cancel()
+	//the channel is closed after the context is done.
+	for range events {
+	}
+}
+
+func TestWatch(t *testing.T) {
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	server := NewApiServer()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		counts[r.URL.Path]++
+		mu.Unlock()
+		server.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	cli := &ApiClient{ApiAddr: ts.Listener.Addr().String()}
+	lionListener, err := cli.Listen("tcp", "localhost:30181", lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lionListener.Close()
+	go echoServe(lionListener)
+	var conns []net.Conn
+	for i := 0; i < 5; i++ {
+		conn, err := cli.Dialer(tigerHostName, 0).Dial("tcp", "localhost:30181")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	err = cli.UpdateNodeState(lionHostName, NodeState{Latency: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, conn := range conns {
+		before := time.Now()
+		buf := []byte("ping")
+		conn.Write(buf)
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if duration := time.Now().Sub(before); duration < 202*time.Millisecond || duration > 300*time.Millisecond {
+			t.Fatal("expected round trip 202ms, actual", duration)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if counts["/watch"] != 1 {
+		t.Fatal("expected one watch stream, actual", counts["/watch"])
+	}
+	if counts["/connState"] != 5 {
+		t.Fatal("expected connState only for the initial states, actual", counts["/connState"])
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	originListener, err := net.Listen("tcp", "localhost:30191")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer originListener.Close()
+	go echoServe(originListener)
+	err = Cli.StartProxy(tigerHostName, lionHostName, "30192", "localhost:30191")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Cli.StopProxy("30192")
+	conn, err := net.Dial("tcp", "localhost:30192")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := []byte("ping")
+	conn.Write(buf)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Cli.UpdateNodeState(lionHostName, NodeState{ExternalDown: true})
+	Cli.DialState(appleHostName, "30192")
+	resp, err := http.Get("http://" + Cli.ApiAddr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	metrics := string(data)
+	for _, line := range []string{
+		`stadis_server_ports{namespace="",host="animal.land.lion"} 1`,
+		`stadis_client_ports{namespace="",host="animal.land.tiger"} 1`,
+		`stadis_proxy_active_connections{namespace="",proxy_port="30192",proxy_name="animal.land.lion"} 1`,
+		`stadis_proxy_relayed_bytes_total{namespace="",proxy_port="30192",direction="upstream"} 4`,
+		`stadis_proxy_relayed_bytes_total{namespace="",proxy_port="30192",direction="downstream"} 4`,
+		`stadis_simulated_delay_seconds_bucket{direction="send",le="+Inf"}`,
+		`stadis_long_poll_waiters{namespace=""}`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Fatal("metric not found", line, "\n", metrics)
+		}
+	}
+	if strings.Contains(metrics, `stadis_dial_failures_total{namespace=""} 0`) {
+		t.Fatal("dial failure not counted")
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	resp, err := http.Get("http://" + Cli.ApiAddr + "/ui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != 200 || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatal(resp.Status, err)
+	}
+	if !bytes.Contains(body, []byte("/nodeState")) {
+		t.Fatal("dashboard should update the node states through /nodeState")
+	}
+	//the events are sent with their types as the names, the dashboard listens to each of them.
+	eventTypes := []string{EventNodeState, EventNodeAdded, EventNodeRemoved, EventServerStarted, EventServerStopped,
+		EventClientConnected, EventClientDisconnected, EventLinkSet, EventLinkRemoved, EventConfig, EventRestore,
+		EventProxyStarted, EventProxyStopped, EventProxyUpdated}
+	for _, evType := range eventTypes {
+		if !bytes.Contains(body, []byte(`"`+evType+`"`)) {
+			t.Fatal("dashboard doesn't listen to event", evType)
+		}
+	}
+	if bytes.Contains(body, []byte("onmessage")) {
+		t.Fatal("named events are not delivered to onmessage")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequest("GET", "http://"+Cli.ApiAddr+"/events", nil)
+	resp, err = http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	Cli.UpdateNodeState(lionHostName, NodeState{Latency: time.Millisecond})
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "event: "+EventNodeState+"\n" {
+		t.Fatal("expected a named event", line, err)
+	}
+	if !bytes.Contains(body, []byte("addEventListener(type, load)")) {
+		t.Fatal("dashboard should reload on the named events")
+	}
+	resp, err = http.Get("http://" + Cli.ApiAddr + "/ui?namespace=unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Fatal("expected 404 for unknown namespace, actual", resp.Status)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lionListener, err := Listen("tcp", "localhost:30201", lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lionListener.Close()
+	go echoServe(lionListener)
+	conn, err := Cli.Dialer(tigerHostName, 0).Dial("tcp", "localhost:30201")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appleConn, err := Cli.Dialer(appleHostName, 0).Dial("tcp", "localhost:30201")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer appleConn.Close()
+	buf := []byte("ping")
+	conn.Write(buf)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns, err := Cli.Connections("", "")
+	if err != nil || len(conns) != 2 {
+		t.Fatal(conns, err)
+	}
+	conns, err = Cli.Connections(tigerHostName, "")
+	if err != nil || len(conns) != 1 {
+		t.Fatal(conns, err)
+	}
+	info := conns[0]
+	if info.ServerPort != 30201 || info.ClientHost != tigerHostName || info.ServerHost != lionHostName {
+		t.Fatal(info)
+	}
+	if !info.State.Send.OK || info.State.Send.Latency != 2*time.Millisecond || time.Since(info.Created) > time.Second {
+		t.Fatal(info)
+	}
+	conns, _ = Cli.Connections("", "plant")
+	if len(conns) != 1 || conns[0].ClientHost != appleHostName {
+		t.Fatal(conns)
+	}
+	//the bytes are reported every second.
+	time.Sleep(connReportInterval + 100*time.Millisecond)
+	conns, _ = Cli.Connections(tigerHostName, "")
+	if len(conns) != 1 || conns[0].SentBytes != 4 || conns[0].RecvBytes != 4 {
+		t.Fatal(conns)
+	}
+	//closing the connection unregisters it.
+	conn.Close()
+	conns, _ = Cli.Connections("", "animal.land.tiger")
+	if len(conns) != 0 {
+		t.Fatal(conns)
+	}
+}
+
+func TestKillConnection(t *testing.T) {
+	err := resetDefaultServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lionListener, err := Listen("tcp", "localhost:30211", lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lionListener.Close()
+	go echoServe(lionListener)
+	dial := func() net.Conn {
+		conn, err := Cli.Dialer(tigerHostName, 0).Dial("tcp", "localhost:30211")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	conn := dial()
+	defer conn.Close()
+	clientPort := conn.LocalAddr().(*net.TCPAddr).Port
+	if err = Cli.KillConnection(clientPort, 30212, ""); err == nil {
+		t.Fatal("unknown connection should fail")
+	}
+	err = Cli.KillConnection(clientPort, 30211, KillReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	buf := make([]byte, 4)
+	if _, err = conn.Read(buf); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("expected ECONNRESET, actual", err)
+	}
+	if _, err = conn.Write(buf); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("expected ECONNRESET, actual", err)
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatal("close after kill should succeed, actual", err)
+	}
+
+	gracefulConn := dial()
+	defer gracefulConn.Close()
+	err = Cli.KillConnection(gracefulConn.LocalAddr().(*net.TCPAddr).Port, 30211, KillGraceful)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err = gracefulConn.Read(buf); err != io.EOF {
+		t.Fatal("expected EOF, actual", err)
+	}
+	if err = gracefulConn.Close(); err != nil {
+		t.Fatal("close after kill should succeed, actual", err)
+	}
+
+	//the client of a proxy gets a RST as well.
+	err = Cli.StartProxy(tigerHostName, appleHostName, "30213", "localhost:30211")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Cli.StopProxy("30213")
+	proxyConn, err := net.Dial("tcp", "localhost:30213")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyConn.Close()
+	proxyConn.Write(buf)
+	_, err = io.ReadFull(proxyConn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns, _ := Cli.Connections("", appleHostName)
+	if len(conns) != 1 || conns[0].ServerPort != 30213 {
+		t.Fatal(conns)
+	}
+	err = Cli.KillConnection(conns[0].ClientPort, 30213, KillReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = proxyConn.Read(buf); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("expected ECONNRESET, actual", err)
+	}
+}
+
 func TestLatency(t *testing.T) {
 	err := resetDefaultServer()
 	if err != nil {
@@ -233,9 +1830,10 @@ func TestLatency(t *testing.T) {
 
 	tigerConn.Read(buf)
 	latency := time.Now().Sub(before)
-	if latency < tigerToAppleState.Latency*2 || latency > tigerToAppleState.Latency*3 {
+	roundTrip := tigerToAppleState.Send.Latency + tigerToAppleState.Recv.Latency
+	if latency < roundTrip || latency > roundTrip*3/2 {
 		defaultServer.DumpNode("")
-		t.Fatal("expected latency", tigerToAppleState.Latency*2, "actual", latency)
+		t.Fatal("expected latency", roundTrip, "actual", latency)
 	}
 }
 
@@ -256,6 +1854,10 @@ func TestProxy(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer Cli.StopProxy(proxyPort)
+	proxies, err := Cli.Proxies()
+	if err != nil || len(proxies) != 1 || proxies[0].ProxyPort != proxyPort || proxies[0].OriginAddr != originAddr {
+		t.Fatal(proxies, err)
+	}
 	testConn, err := net.DialTimeout("tcp", "localhost:"+proxyPort, time.Second)
 	if err != nil {
 		t.Fatal(err)
@@ -310,6 +1912,38 @@ func TestProxy(t *testing.T) {
 	if !bytes.Equal(readData, writeData) {
 		t.Error("read data should be equal to wrttien data")
 	}
+
+	//the proxy keeps accepting after it fails to dial the origin.
+	lateOriginAddr := "localhost:6547"
+	err = Cli.StartProxy(localName, proxyName, "6578", lateOriginAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Cli.StopProxy("6578")
+	failedConn, err := net.Dial("tcp", "localhost:6578")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer failedConn.Close()
+	if _, err = failedConn.Read(readData); err == nil {
+		t.Fatal("the connection should be closed without the origin")
+	}
+	lateOriginListener, err := net.Listen("tcp", lateOriginAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lateOriginListener.Close()
+	go echoServe(lateOriginListener)
+	lateConn, err := net.Dial("tcp", "localhost:6578")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lateConn.Close()
+	lateConn.SetReadDeadline(time.Now().Add(time.Second))
+	lateConn.Write(writeData[:4])
+	if _, err = io.ReadFull(lateConn, readData[:4]); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func echoServe(listener net.Listener) {
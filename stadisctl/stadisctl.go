@@ -0,0 +1,385 @@
+//stadisctl controls a stadis API server from the command line, run it without arguments for the usage.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coocood/stadis"
+)
+
+//returned by run if the command line is invalid.
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, stadis.Cli)
+	if err == errUsage {
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "stadisctl:", err)
+		os.Exit(1)
+	}
+}
+
+//ctl runs a command against the API server and prints the output.
+type ctl struct {
+	cli     *stadis.ApiClient
+	out     io.Writer
+	jsonOut bool
+}
+
+//run the command line without the program name, 'cli' is used unless '-addr' or '-namespace' is given.
+func run(args []string, out io.Writer, cli *stadis.ApiClient) (err error) {
+	fs := flag.NewFlagSet("stadisctl", flag.ContinueOnError)
+	fs.Usage = func() {}
+	addr := fs.String("addr", cli.ApiAddr, "the address of the API server")
+	namespace := fs.String("namespace", cli.Namespace, "the namespace on the API server")
+	jsonOut := fs.Bool("json", false, "print the output in json instead of a human readable tree")
+	if fs.Parse(args) != nil {
+		return errUsage
+	}
+	if *addr != cli.ApiAddr {
+		cli = &stadis.ApiClient{ApiAddr: *addr, Namespace: cli.Namespace}
+	}
+	if *namespace != cli.Namespace {
+		cli = cli.WithNamespace(*namespace)
+	}
+	c := &ctl{cli: cli, out: out, jsonOut: *jsonOut}
+	args = fs.Args()
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch args[0] {
+	case "node":
+		err = c.nodeCmd(args[1:])
+	case "proxy":
+		err = c.proxyCmd(args[1:])
+	case "config":
+		err = c.configCmd(args[1:])
+	case "dial-state":
+		err = c.dialStateCmd(args[1:])
+	case "conns":
+		err = c.connsCmd(args[1:])
+	default:
+		err = errUsage
+	}
+	return
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: stadisctl [-addr localhost:8989] [-namespace name] [-json] command [arguments]
+
+commands:
+	node get <name>
+	node set <name> [--latency 50ms] [--internal-down] [--external-down] [--jitter 5ms] [--distribution normal]
+		[--bandwidth 1048576] [--loss-rate 0.01] [--dup-rate 0.01]
+	node add <name> [the same flags as node set]
+	node remove <name> [--force]
+	proxy start --client <name> --name <name> --port <port> --origin <addr>
+	proxy stop <port>
+	proxy list
+	config load <file> [--merge]
+	config dump
+	dial-state <clientName> <serverPort>
+	conns [--host <name>] [--prefix <node>]`)
+}
+
+//the first argument is the sub command, the second one is the name if 'named'.
+func subCommand(args []string, cmd string, named bool) (sub, name string, rest []string, err error) {
+	if len(args) == 0 {
+		err = fmt.Errorf("%s: sub command required", cmd)
+		return
+	}
+	sub, rest = args[0], args[1:]
+	if named {
+		if len(rest) == 0 || strings.HasPrefix(rest[0], "-") {
+			err = fmt.Errorf("%s %s: name required", cmd, sub)
+			return
+		}
+		name, rest = rest[0], rest[1:]
+	}
+	return
+}
+
+func (c *ctl) printJSON(v interface{}) {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Fprintln(c.out, string(data))
+}
+
+func (c *ctl) nodeCmd(args []string) (err error) {
+	sub, name, rest, err := subCommand(args, "node", true)
+	if err != nil {
+		return
+	}
+	switch sub {
+	case "get":
+		var state stadis.NodeState
+		state, err = c.cli.NodeState(name)
+		if err != nil {
+			return
+		}
+		if c.jsonOut {
+			c.printJSON(state)
+		} else {
+			fmt.Fprintln(c.out, name, formatState(state))
+		}
+	case "set":
+		var state stadis.NodeState
+		state, err = c.cli.NodeState(name)
+		if err != nil {
+			return
+		}
+		err = parseStateFlags("node set", rest, &state)
+		if err != nil {
+			return
+		}
+		err = c.cli.UpdateNodeState(name, state)
+	case "add":
+		var state *stadis.NodeState
+		if len(rest) > 0 {
+			state = new(stadis.NodeState)
+			err = parseStateFlags("node add", rest, state)
+			if err != nil {
+				return
+			}
+		}
+		err = c.cli.AddNode(name, state)
+	case "remove":
+		fs := flag.NewFlagSet("node remove", flag.ContinueOnError)
+		force := fs.Bool("force", false, "unregister the open ports of the node")
+		err = fs.Parse(rest)
+		if err != nil {
+			return
+		}
+		err = c.cli.RemoveNode(name, *force)
+	default:
+		err = fmt.Errorf("node: unknown sub command %s", sub)
+	}
+	return
+}
+
+//only the flags set in the arguments are changed in the state.
+func parseStateFlags(cmd string, args []string, state *stadis.NodeState) (err error) {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.DurationVar(&state.Latency, "latency", state.Latency, "the latency of the node")
+	fs.BoolVar(&state.InternalDown, "internal-down", state.InternalDown, "the node is down for the nodes inside it")
+	fs.BoolVar(&state.ExternalDown, "external-down", state.ExternalDown, "the node is down for the nodes outside it")
+	fs.DurationVar(&state.Jitter, "jitter", state.Jitter, "the jitter of the latency")
+	fs.StringVar(&state.Distribution, "distribution", state.Distribution, "the distribution of the jitter, uniform, normal or pareto")
+	fs.Int64Var(&state.Bandwidth, "bandwidth", state.Bandwidth, "the bandwidth in bytes per second, 0 for unlimited")
+	fs.Float64Var(&state.LossRate, "loss-rate", state.LossRate, "the probability of a packet to be lost")
+	fs.Float64Var(&state.DupRate, "dup-rate", state.DupRate, "the probability of a datagram to be duplicated")
+	return fs.Parse(args)
+}
+
+func formatState(state stadis.NodeState) string {
+	parts := []string{"latency:" + state.Latency.String()}
+	if state.InternalDown {
+		parts = append(parts, "internal-down")
+	}
+	if state.ExternalDown {
+		parts = append(parts, "external-down")
+	}
+	if state.Jitter != 0 {
+		dist := state.Distribution
+		if dist == "" {
+			dist = "uniform"
+		}
+		parts = append(parts, fmt.Sprintf("jitter:%v(%s)", state.Jitter, dist))
+	}
+	if state.Bandwidth != 0 {
+		parts = append(parts, fmt.Sprintf("bandwidth:%dB/s", state.Bandwidth))
+	}
+	if state.LossRate != 0 {
+		parts = append(parts, fmt.Sprintf("loss-rate:%v", state.LossRate))
+	}
+	if state.DupRate != 0 {
+		parts = append(parts, fmt.Sprintf("dup-rate:%v", state.DupRate))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (c *ctl) proxyCmd(args []string) (err error) {
+	sub, _, rest, err := subCommand(args, "proxy", false)
+	if err != nil {
+		return
+	}
+	switch sub {
+	case "start":
+		fs := flag.NewFlagSet("proxy start", flag.ContinueOnError)
+		clientName := fs.String("client", "", "where the clients of the proxy are located")
+		proxyName := fs.String("name", "", "where the proxy is located")
+		proxyPort := fs.String("port", "", "the port the proxy listens on")
+		originAddr := fs.String("origin", "", "the address of the origin server")
+		err = fs.Parse(rest)
+		if err != nil {
+			return
+		}
+		if *clientName == "" || *proxyName == "" || *proxyPort == "" || *originAddr == "" {
+			return fmt.Errorf("proxy start: --client, --name, --port and --origin required")
+		}
+		err = c.cli.StartProxy(*clientName, *proxyName, *proxyPort, *originAddr)
+	case "stop":
+		if len(rest) == 0 {
+			return fmt.Errorf("proxy stop: port required")
+		}
+		err = c.cli.StopProxy(rest[0])
+	case "list":
+		var proxies []stadis.Proxy
+		proxies, err = c.cli.Proxies()
+		if err != nil {
+			return
+		}
+		if c.jsonOut {
+			c.printJSON(proxies)
+			return
+		}
+		for _, p := range proxies {
+			fmt.Fprintf(c.out, "%s %s -> %s client:%s\n", p.ProxyPort, p.ProxyName, p.OriginAddr, p.ClientName)
+		}
+	default:
+		err = fmt.Errorf("proxy: unknown sub command %s", sub)
+	}
+	return
+}
+
+func (c *ctl) configCmd(args []string) (err error) {
+	sub, _, rest, err := subCommand(args, "config", false)
+	if err != nil {
+		return
+	}
+	switch sub {
+	case "load":
+		if len(rest) == 0 || strings.HasPrefix(rest[0], "-") {
+			return fmt.Errorf("config load: file required")
+		}
+		fileName := rest[0]
+		fs := flag.NewFlagSet("config load", flag.ContinueOnError)
+		merge := fs.Bool("merge", false, "keep the registered ports whose hosts still exist")
+		err = fs.Parse(rest[1:])
+		if err != nil {
+			return
+		}
+		var file *os.File
+		file, err = os.Open(fileName)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		if *merge {
+			err = c.cli.MergeConfig(file)
+		} else {
+			err = c.cli.UpdateConfig(file)
+		}
+	case "dump":
+		var config *stadis.Config
+		config, err = c.cli.Config()
+		if err != nil {
+			return
+		}
+		if c.jsonOut {
+			c.printJSON(config)
+			return
+		}
+		c.printTree(config)
+	default:
+		err = fmt.Errorf("config: unknown sub command %s", sub)
+	}
+	return
+}
+
+func (c *ctl) printTree(config *stadis.Config) {
+	for _, dc := range config.DataCenters {
+		fmt.Fprintln(c.out, dc.Name, formatState(*dc.NodeState))
+		for _, rack := range dc.Racks {
+			fmt.Fprintln(c.out, "  "+rack.Name, formatState(*rack.NodeState))
+			for _, host := range rack.Hosts {
+				line := "    " + host.Name + " " + formatState(*host.NodeState)
+				if len(host.Ports) > 0 {
+					line += fmt.Sprintf(" ports:%v", host.Ports)
+				}
+				fmt.Fprintln(c.out, line)
+			}
+		}
+	}
+	for _, link := range config.Links {
+		arrow := "<->"
+		if link.OneWay {
+			arrow = "->"
+		}
+		line := fmt.Sprintf("link %s%s%s latency:%v", link.From, arrow, link.To, link.Latency)
+		if link.Down {
+			line += " down"
+		}
+		fmt.Fprintln(c.out, line)
+	}
+}
+
+func (c *ctl) dialStateCmd(args []string) (err error) {
+	if len(args) < 2 {
+		return fmt.Errorf("dial-state: clientName and serverPort required")
+	}
+	state, err := c.cli.DialState(args[0], args[1])
+	if err != nil {
+		return
+	}
+	if c.jsonOut {
+		c.printJSON(state)
+		return
+	}
+	fmt.Fprintf(c.out, "%s -> %s ok:%v latency:%v\n", args[0], args[1], state.OK, state.Latency)
+	return
+}
+
+func (c *ctl) connsCmd(args []string) (err error) {
+	fs := flag.NewFlagSet("conns", flag.ContinueOnError)
+	host := fs.String("host", "", "only the connections from or to the host")
+	prefix := fs.String("prefix", "", "only the connections from or to the hosts under the node")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	conns, err := c.cli.Connections(*host, *prefix)
+	if err != nil {
+		return
+	}
+	if c.jsonOut {
+		c.printJSON(conns)
+		return
+	}
+	//group the connections by client host.
+	groups := make(map[string][]stadis.ConnInfo)
+	var hosts []string
+	for _, conn := range conns {
+		if groups[conn.ClientHost] == nil {
+			hosts = append(hosts, conn.ClientHost)
+		}
+		groups[conn.ClientHost] = append(groups[conn.ClientHost], conn)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		fmt.Fprintln(c.out, h)
+		for _, conn := range groups[h] {
+			fmt.Fprintf(c.out, "  %d -> %s:%d sent:%dB recv:%dB age:%v send:%s recv:%s\n",
+				conn.ClientPort, conn.ServerHost, conn.ServerPort, conn.SentBytes, conn.RecvBytes,
+				time.Since(conn.Created).Round(time.Second), formatFlow(conn.State.Send), formatFlow(conn.State.Recv))
+		}
+	}
+	return
+}
+
+func formatFlow(state stadis.FlowState) string {
+	if !state.OK {
+		return "down"
+	}
+	return state.Latency.String()
+}
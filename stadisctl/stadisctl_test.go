@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coocood/stadis"
+)
+
+const (
+	lionHostName  = "animal.land.lion"
+	tigerHostName = "animal.land.tiger"
+)
+
+func newTestClient() (cli *stadis.ApiClient, closeFunc func()) {
+	ts := httptest.NewServer(stadis.NewApiServer())
+	return &stadis.ApiClient{ApiAddr: ts.Listener.Addr().String()}, ts.Close
+}
+
+//run the command line and return the output.
+func runCmd(t *testing.T, cli *stadis.ApiClient, args ...string) string {
+	var out bytes.Buffer
+	err := run(args, &out, cli)
+	if err != nil {
+		t.Fatal(args, err)
+	}
+	return out.String()
+}
+
+func TestNodeSet(t *testing.T) {
+	cli, closeFunc := newTestClient()
+	defer closeFunc()
+	err := cli.UpdateNodeState(lionHostName, stadis.NodeState{Latency: 5 * time.Millisecond, Jitter: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//only the flags set in the arguments are changed.
+	runCmd(t, cli, "node", "set", lionHostName, "--internal-down")
+	state, _ := cli.NodeState(lionHostName)
+	expected := stadis.NodeState{Latency: 5 * time.Millisecond, Jitter: time.Millisecond, InternalDown: true}
+	if state != expected {
+		t.Fatal("expected", expected, "actual", state)
+	}
+	runCmd(t, cli, "node", "set", lionHostName, "--latency", "20ms", "--bandwidth", "1024")
+	state, _ = cli.NodeState(lionHostName)
+	expected = stadis.NodeState{Latency: 20 * time.Millisecond, Jitter: time.Millisecond, InternalDown: true, Bandwidth: 1024}
+	if state != expected {
+		t.Fatal("expected", expected, "actual", state)
+	}
+	if err = run([]string{"node", "set", lionHostName, "--unknown"}, ioutil.Discard, cli); err == nil {
+		t.Fatal("unknown flag should fail")
+	}
+	if err = run([]string{"node", "set"}, ioutil.Discard, cli); err == nil {
+		t.Fatal("missing name should fail")
+	}
+}
+
+func TestOutput(t *testing.T) {
+	cli, closeFunc := newTestClient()
+	defer closeFunc()
+	cli.UpdateNodeState(lionHostName, stadis.NodeState{Latency: 5 * time.Millisecond, ExternalDown: true})
+
+	out := runCmd(t, cli, "node", "get", lionHostName)
+	if out != lionHostName+" latency:5ms external-down\n" {
+		t.Fatalf("unexpected tree output %q", out)
+	}
+	out = runCmd(t, cli, "-json", "node", "get", lionHostName)
+	var state stadis.NodeState
+	if err := json.Unmarshal([]byte(out), &state); err != nil || state.Latency != 5*time.Millisecond || !state.ExternalDown {
+		t.Fatal(out, err)
+	}
+
+	out = runCmd(t, cli, "config", "dump")
+	if !strings.Contains(out, "\n  land latency:") || !strings.Contains(out, "\n    lion latency:5ms external-down\n") {
+		t.Fatal("unexpected tree output", out)
+	}
+	out = runCmd(t, cli, "-json", "config", "dump")
+	var config stadis.Config
+	if err := json.Unmarshal([]byte(out), &config); err != nil || len(config.DataCenters) == 0 {
+		t.Fatal(out, err)
+	}
+
+	//lion is down for the nodes outside it.
+	cli.ServerStarted(lionHostName, "30241")
+	out = runCmd(t, cli, "dial-state", tigerHostName, "30241")
+	if !strings.HasPrefix(out, tigerHostName+" -> 30241 ok:false latency:") {
+		t.Fatal("unexpected dial state", out)
+	}
+	out = runCmd(t, cli, "-json", "dial-state", tigerHostName, "30241")
+	var dialState stadis.DialState
+	if err := json.Unmarshal([]byte(out), &dialState); err != nil || dialState.OK {
+		t.Fatal(out, err)
+	}
+	if err := run([]string{"dial-state", tigerHostName}, ioutil.Discard, cli); err == nil {
+		t.Fatal("missing server port should fail")
+	}
+	if err := run([]string{"unknown"}, ioutil.Discard, cli); err != errUsage {
+		t.Fatal("unknown command should be a usage error, actual", err)
+	}
+	if err := run(nil, ioutil.Discard, cli); err != errUsage {
+		t.Fatal("missing command should be a usage error, actual", err)
+	}
+}
+
+func TestRouting(t *testing.T) {
+	cli, closeFunc := newTestClient()
+	defer closeFunc()
+
+	//proxy
+	runCmd(t, cli, "proxy", "start", "--client", tigerHostName, "--name", lionHostName, "--port", "30241", "--origin", "localhost:30242")
+	out := runCmd(t, cli, "proxy", "list")
+	if out != "30241 "+lionHostName+" -> localhost:30242 client:"+tigerHostName+"\n" {
+		t.Fatalf("unexpected proxy list %q", out)
+	}
+	runCmd(t, cli, "proxy", "stop", "30241")
+	if out = runCmd(t, cli, "proxy", "list"); out != "" {
+		t.Fatalf("proxy should be stopped, actual %q", out)
+	}
+
+	//conns
+	listener, err := cli.Listen("tcp", "localhost:30243", lionHostName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			ioutil.ReadAll(conn)
+		}
+	}()
+	conn, err := cli.Dialer(tigerHostName, 0).Dial("tcp", "localhost:30243")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	out = runCmd(t, cli, "conns", "--host", tigerHostName)
+	if !strings.HasPrefix(out, tigerHostName+"\n") || !strings.Contains(out, " -> "+lionHostName+":30243 ") {
+		t.Fatal("unexpected conns output", out)
+	}
+	out = runCmd(t, cli, "-json", "conns", "--prefix", "plant")
+	if strings.TrimSpace(out) != "[]" {
+		t.Fatal("no connection expected under plant, actual", out)
+	}
+
+	//config
+	cli.UpdateNodeState(lionHostName, stadis.NodeState{Latency: 99 * time.Millisecond})
+	dir, err := ioutil.TempDir("", "stadisctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(fileName, stadis.DefaultConfig, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCmd(t, cli, "config", "load", fileName, "--merge")
+	state, _ := cli.NodeState(lionHostName)
+	if state.Latency == 99*time.Millisecond {
+		t.Fatal("the config should be loaded")
+	}
+
+	//namespace
+	err = cli.CreateNamespace("ctl", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCmd(t, cli, "-namespace", "ctl", "node", "set", lionHostName, "--latency", "7ms")
+	state, _ = cli.WithNamespace("ctl").NodeState(lionHostName)
+	if state.Latency != 7*time.Millisecond {
+		t.Fatal("node in the namespace should be changed, actual", state)
+	}
+}
@@ -3,15 +3,37 @@ package main
 import (
 	"flag"
 	"github.com/coocood/stadis"
+	"log"
 	"net/http"
+	"os"
 )
 
 var port = flag.String("port", "", "the port to listen on")
+var configFile = flag.String("config", "", "the config file to start with, the proxies in it are started, 'DefaultConfig' is used if empty")
+var stateDir = flag.String("state", "", "the directory to save the state on every change, the saved state overrides the config file on restart")
 
 func main() {
 	flag.Parse()
 	if *port != "" {
 		stadis.Cli.ApiAddr = "localhost:" + *port
 	}
-	http.ListenAndServe(stadis.Cli.ApiAddr, stadis.NewApiServer())
+	server := stadis.NewApiServer()
+	if *configFile != "" {
+		file, err := os.Open(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = server.LoadConfig(file)
+		file.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *stateDir != "" {
+		err := server.PersistState(*stateDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	http.ListenAndServe(stadis.Cli.ApiAddr, server)
 }
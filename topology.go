@@ -6,14 +6,17 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+//How long the read and write through a down network take to time out, a var so the tests can shorten it.
+var tcpTimeOut = 15 * time.Minute
+
 const (
-	tcpTimeOut     = 15 * time.Minute
 	dialTimeOut    = 3 * time.Minute
 	serverPortType = true
 	clientPortType = false
@@ -22,6 +25,7 @@ const (
 type node interface {
 	state() NodeState
 	setState(state NodeState)
+	fullName() string
 	String() string
 }
 
@@ -43,13 +47,17 @@ func (dc *dataCenter) setState(state NodeState) {
 	dc.NodeState = state
 }
 
+func (dc *dataCenter) fullName() string {
+	return dc.name
+}
+
 func (dc *dataCenter) String() string {
 	var racks []*rack
 	for _, rack := range dc.rackMap {
 		racks = append(racks, rack)
 	}
-	return fmt.Sprintf("\nname:%v internalDown:%v externalDown:%v latency:%v racks:%v",
-		dc.name, dc.InternalDown, dc.ExternalDown, dc.Latency, racks)
+	return fmt.Sprintf("\nname:%v internalDown:%v externalDown:%v latency:%v jitter:%v bandwidth:%v racks:%v",
+		dc.name, dc.InternalDown, dc.ExternalDown, dc.Latency, dc.Jitter, dc.Bandwidth, racks)
 }
 
 func newDc(confDC *DataCenter, topo *topology) (dc *dataCenter) {
@@ -90,13 +98,17 @@ func (r *rack) setState(state NodeState) {
 	r.NodeState = state
 }
 
+func (rack *rack) fullName() string {
+	return rack.dataCenter.name + "." + rack.name
+}
+
 func (rack *rack) String() string {
 	var hosts []*host
 	for _, host := range rack.hostMap {
 		hosts = append(hosts, host)
 	}
-	return fmt.Sprintf("\n\tname:%v internalDown:%v externalDown:%v latency:%v hosts:%v",
-		rack.name, rack.InternalDown, rack.ExternalDown, rack.Latency, hosts)
+	return fmt.Sprintf("\n\tname:%v internalDown:%v externalDown:%v latency:%v jitter:%v bandwidth:%v hosts:%v",
+		rack.name, rack.InternalDown, rack.ExternalDown, rack.Latency, rack.Jitter, rack.Bandwidth, hosts)
 }
 
 func newRack(confRack *Rack, dc *dataCenter) (r *rack) {
@@ -140,8 +152,17 @@ func (host *host) String() string {
 	for port := range host.portMap {
 		ports = append(ports, port)
 	}
-	return fmt.Sprintf("\n\t\tname:%v internalDown:%v externalDown:%v latency:%v ports:\n\t\t\t%v",
-		host.name, host.InternalDown, host.ExternalDown, host.Latency, ports)
+	return fmt.Sprintf("\n\t\tname:%v internalDown:%v externalDown:%v latency:%v jitter:%v bandwidth:%v ports:\n\t\t\t%v",
+		host.name, host.InternalDown, host.ExternalDown, host.Latency, host.Jitter, host.Bandwidth, ports)
+}
+
+func (host *host) fullName() string {
+	return host.rack.fullName() + "." + host.name
+}
+
+//the nodes from the host up to the data center.
+func (host *host) path() []node {
+	return []node{host, host.rack, host.rack.dataCenter}
 }
 
 func newHost(confHost *Host, rack *rack) (h *host) {
@@ -165,19 +186,57 @@ type topology struct {
 	DcLatency     time.Duration
 	ports         map[int]*host //ports to host map
 	dataCenterMap map[string]*dataCenter
+	links         map[linkKey]*Link
+	snapshots     map[string]*snapshot
+	conns         map[int]*ConnInfo //client port to the open connection
+	events        *eventHub
+	defaults      [3]*NodeState //the default states of data center, rack and host in the config.
 	mutex         sync.RWMutex
 	updateCh      chan struct{}
 }
 
+//there can be only one link between two nodes, so the key is ordered by name.
+type linkKey struct {
+	a, b string
+}
+
+func newLinkKey(from, to string) linkKey {
+	if from > to {
+		from, to = to, from
+	}
+	return linkKey{from, to}
+}
+
 func (topo *topology) String() (s string) {
 	var dcs []*dataCenter
 	for _, dc := range topo.dataCenterMap {
 		dcs = append(dcs, dc)
 	}
 	s = fmt.Sprint(dcs)
+	for _, link := range topo.sortedLinks() {
+		arrow := "<->"
+		if link.OneWay {
+			arrow = "->"
+		}
+		s += fmt.Sprintf("\nlink:%v%v%v down:%v latency:%v jitter:%v bandwidth:%v",
+			link.From, arrow, link.To, link.Down, link.Latency, link.Jitter, link.Bandwidth)
+	}
 	return
 }
 
+//close the update channel and make a new one, so all the blocking requests will get their new states.
+func (topo *topology) notifyUpdate() {
+	close(topo.updateCh)
+	topo.updateCh = make(chan struct{})
+}
+
+//the topology is replaced or deleted, wake up all the blocking requests.
+func (topo *topology) discard() {
+	topo.mutex.Lock()
+	topo.notifyUpdate()
+	topo.mutex.Unlock()
+}
+
 //When a server port is added, the topology need to close update channel, and make a new one.
 //So all the blocking request will get their new states.
 //It's not necessary when adding client port, because adding a client port won't affect any other connections.
@@ -196,9 +255,9 @@ func (topo *topology) addServerPort(name string, port int) (err error) {
 	}
 	host.portMap[port] = serverPortType
 	topo.ports[port] = host
+	topo.events.publish(Event{Type: EventServerStarted, Name: host.fullName(), Port: port})
 
-	close(topo.updateCh)
-	topo.updateCh = make(chan struct{})
+	topo.notifyUpdate()
 	return nil
 }
 
@@ -223,8 +282,8 @@ func (topo *topology) removeServerPort(name string, port int) (err error) {
 	}
 
 	delete(host.portMap, port)
-	close(topo.updateCh)
-	topo.updateCh = make(chan struct{})
+	topo.events.publish(Event{Type: EventServerStopped, Name: host.fullName(), Port: port})
+	topo.notifyUpdate()
 	return nil
 }
 
@@ -243,6 +302,7 @@ func (topo *topology) addClientPort(name string, port int) (err error) {
 	}
 	host.portMap[port] = clientPortType
 	topo.ports[port] = host
+	topo.events.publish(Event{Type: EventClientConnected, Name: host.fullName(), Port: port})
 	return
 }
 
@@ -268,20 +328,28 @@ func (topo *topology) removeClientPort(port int) (err error) {
 	}
 	delete(host.portMap, port)
 	delete(topo.ports, port)
+	delete(topo.conns, port)
+	topo.events.publish(Event{Type: EventClientDisconnected, Name: host.fullName(), Port: port})
 	return
 }
 
 func (topo *topology) setNodeState(nodeName string, newState NodeState) (err error) {
 	topo.mutex.Lock()
 	defer topo.mutex.Unlock()
+	err = validNodeState(newState)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 	node, err := topo.lookup(nodeName)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	node.setState(newState)
-	close(topo.updateCh)
-	topo.updateCh = make(chan struct{})
+	state := node.state()
+	topo.events.publish(Event{Type: EventNodeState, Name: node.fullName(), NodeState: &state})
+	topo.notifyUpdate()
 	return
 }
 
@@ -298,7 +366,165 @@ func (topo *topology) nodeState(nodeName string) (nodeState NodeState, err error
 	return
 }
 
-func (topo *topology) dialState(clientName string, serverPort int) (connState ConnState, err error) {
+func validNodeState(state NodeState) (err error) {
+	if !validDistribution(state.Distribution) {
+		err = errors.New("unknown distribution " + state.Distribution)
+		return
+	}
+	if !validRate(state.LossRate) || !validRate(state.DupRate) {
+		err = errors.New("loss rate and dup rate should be between 0 and 1")
+		return
+	}
+	return
+}
+
+//Insert a data center, rack or host into the live topology, its parent must exist.
+//If 'state' is nil, the default state of its level in the config is used.
+func (topo *topology) addNode(nodeName string, state *NodeState) (err error) {
+	topo.mutex.Lock()
+	defer topo.mutex.Unlock()
+	parts := strings.Split(nodeName, ".")
+	if len(parts) > 3 {
+		err = errors.New("invalid node name " + nodeName)
+		log.Println(err)
+		return
+	}
+	for _, part := range parts {
+		if part == "" {
+			err = errors.New("invalid node name " + nodeName)
+			log.Println(err)
+			return
+		}
+	}
+	if state == nil {
+		state = topo.defaults[len(parts)-1]
+	}
+	if state == nil {
+		state = new(NodeState)
+	}
+	err = validNodeState(*state)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if _, lookupErr := topo.lookup(nodeName); lookupErr == nil {
+		err = errors.New("node exists already " + nodeName)
+		log.Println(err)
+		return
+	}
+	name := parts[len(parts)-1]
+	switch len(parts) {
+	case 1:
+		topo.dataCenterMap[name] = newDc(&DataCenter{Name: name, NodeState: state}, topo)
+	case 2:
+		var parent node
+		parent, err = topo.lookup(parts[0])
+		if err != nil {
+			return
+		}
+		dc := parent.(*dataCenter)
+		dc.rackMap[name] = newRack(&Rack{Name: name, NodeState: state}, dc)
+	case 3:
+		var parent node
+		parent, err = topo.lookup(parts[0] + "." + parts[1])
+		if err != nil {
+			return
+		}
+		rack := parent.(*rack)
+		rack.hostMap[name] = newHost(&Host{Name: name, NodeState: state}, rack)
+	}
+	nodeState := *state
+	topo.events.publish(Event{Type: EventNodeAdded, Name: nodeName, NodeState: &nodeState})
+	topo.notifyUpdate()
+	return
+}
+
+//Delete a data center, rack or host from the live topology with the links attached to it or its descendants.
+//It is refused if any host under the node has registered ports, unless 'force' is true,
+//then the ports are unregistered and the connections on them fail on the next state update.
+func (topo *topology) removeNode(nodeName string, force bool) (err error) {
+	topo.mutex.Lock()
+	defer topo.mutex.Unlock()
+	nod, err := topo.lookup(nodeName)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var hosts []*host
+	switch n := nod.(type) {
+	case *dataCenter:
+		for _, rack := range n.rackMap {
+			for _, host := range rack.hostMap {
+				hosts = append(hosts, host)
+			}
+		}
+	case *rack:
+		for _, host := range n.hostMap {
+			hosts = append(hosts, host)
+		}
+	case *host:
+		hosts = append(hosts, n)
+	}
+	for _, host := range hosts {
+		if len(host.portMap) > 0 && !force {
+			err = errors.New("node has open ports " + host.fullName())
+			log.Println(err)
+			return
+		}
+	}
+	for _, host := range hosts {
+		for port, portType := range host.portMap {
+			delete(topo.ports, port)
+			delete(topo.conns, port)
+			evType := EventServerStopped
+			if portType == clientPortType {
+				evType = EventClientDisconnected
+			}
+			topo.events.publish(Event{Type: evType, Name: host.fullName(), Port: port})
+		}
+		host.portMap = make(map[int]bool)
+	}
+	switch n := nod.(type) {
+	case *dataCenter:
+		delete(topo.dataCenterMap, n.name)
+	case *rack:
+		delete(n.dataCenter.rackMap, n.name)
+	case *host:
+		delete(n.rack.hostMap, n.name)
+	}
+	for key, link := range topo.links {
+		if containsNode(nodeName, link.From) || containsNode(nodeName, link.To) {
+			delete(topo.links, key)
+		}
+	}
+	for _, snap := range topo.snapshots {
+		snap.removeNode(nodeName)
+	}
+	topo.events.publish(Event{Type: EventNodeRemoved, Name: nodeName})
+	topo.notifyUpdate()
+	return
+}
+
+//the state of the datagrams sent from the host to the port.
+func (topo *topology) packetState(srcName string, dstPort int) (state FlowState, err error) {
+	topo.mutex.RLock()
+	defer topo.mutex.RUnlock()
+	srcHost, err := topo.lookupHost(srcName)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	dstHost := topo.ports[dstPort]
+	if dstHost == nil {
+		err = errPortNotRegistered
+		return
+	}
+	_, portOk := dstHost.portMap[dstPort]
+	state = flowState(srcHost, dstHost, portOk)
+	return
+}
+
+func (topo *topology) dialState(clientName string, serverPort int) (dialState DialState, err error) {
 	topo.mutex.RLock()
 	defer topo.mutex.RUnlock()
 	clientHost, err := topo.lookupHost(clientName)
@@ -314,23 +540,34 @@ func (topo *topology) dialState(clientName string, serverPort int) (connState Co
 		return
 	}
 
-	networkOk, latency := computeNetworkState(clientHost, serverHost)
+	//dial needs both directions, so it has the latency of a round trip.
+	send := computeFlowState(clientHost, serverHost)
+	recv := computeFlowState(serverHost, clientHost)
 
-	if networkOk {
-		_, connState.OK = serverHost.portMap[serverPort]
-		connState.Latency = latency * 2 //dial has double latency.
+	if send.OK && recv.OK {
+		_, dialState.OK = serverHost.portMap[serverPort]
+		dialState.Latency = send.Latency + recv.Latency
+		dialState.Jitter = send.Jitter + recv.Jitter
+		dialState.LossRate = 1 - (1-send.LossRate)*(1-recv.LossRate)
+		dialState.Distribution = send.Distribution
+		if recv.Jitter > send.Jitter {
+			dialState.Distribution = recv.Distribution
+		}
 	} else {
-		connState.OK = false
-		connState.Latency = dialTimeOut
+		dialState.OK = false
+		dialState.Latency = dialTimeOut
 	}
 	return
 }
 
-
 //compute the state of the connection based on entire network state.
 func (topo *topology) connState(clientPort, serverPort int) (connState ConnState, err error) {
 	topo.mutex.RLock()
 	defer topo.mutex.RUnlock()
+	return topo.computeConnState(clientPort, serverPort)
+}
+
+func (topo *topology) computeConnState(clientPort, serverPort int) (connState ConnState, err error) {
 	clientHost := topo.ports[clientPort]
 	if clientHost == nil {
 		err = fmt.Errorf("connState:unknown client port %d", clientPort)
@@ -346,40 +583,244 @@ func (topo *topology) connState(clientPort, serverPort int) (connState ConnState
 	if !ok {
 		return
 	}
+	_, serverPortOk := serverHost.portMap[serverPort]
+	connState.Send = flowState(clientHost, serverHost, serverPortOk)
+	connState.Recv = flowState(serverHost, clientHost, serverPortOk)
+	return
+}
 
-	networkOk, latency := computeNetworkState(clientHost, serverHost)
-
-	if networkOk {
-		_, connState.OK = serverHost.portMap[serverPort]
-		connState.Latency = latency
+func flowState(srcHost, dstHost *host, portOk bool) (state FlowState) {
+	state = computeFlowState(srcHost, dstHost)
+	if state.OK {
+		state.OK = portOk
 	} else {
-		connState.OK = false
-		connState.Latency = tcpTimeOut
+		state = FlowState{Latency: tcpTimeOut}
 	}
 	return
 }
 
-//compute network connection state between client and server host, no ports involved.
-func computeNetworkState(clientHost, serverHost *host) (ok bool, latency time.Duration) {
-	clientSideDown := clientHost.InternalDown
-	serverSideDown := serverHost.InternalDown
-	if clientHost != serverHost {
-		clientSideDown = clientSideDown || clientHost.ExternalDown || clientHost.rack.InternalDown
-		serverSideDown = serverSideDown || serverHost.ExternalDown || serverHost.rack.InternalDown
-		latency += clientHost.Latency + serverHost.Latency
-		if clientHost.rack != serverHost.rack {
-			clientSideDown = clientSideDown || clientHost.rack.ExternalDown || clientHost.rack.dataCenter.InternalDown
-			serverSideDown = serverSideDown || serverHost.rack.ExternalDown || serverHost.rack.dataCenter.InternalDown
-			latency += clientHost.rack.Latency + serverHost.rack.Latency
-			if clientHost.rack.dataCenter != serverHost.rack.dataCenter {
-				clientSideDown = clientSideDown || clientHost.rack.dataCenter.ExternalDown
-				serverSideDown = serverSideDown || serverHost.rack.dataCenter.ExternalDown
-				latency += clientHost.rack.dataCenter.Latency + serverHost.rack.dataCenter.Latency
+//compute network state of the data flowing from source host to destination host, no ports involved.
+func computeFlowState(srcHost, dstHost *host) (state FlowState) {
+	srcPath := srcHost.path()
+	dstPath := dstHost.path()
+	//the number of nodes the data goes through on each side before it reaches the other side.
+	srcLevels := 0
+	for srcLevels < len(srcPath) && srcPath[srcLevels] != dstPath[srcLevels] {
+		srcLevels++
+	}
+	dstLevels := srcLevels
+	ps := pathState{deliveryRate: 1, singleRate: 1}
+	link, from, to, srcLinkLevels, dstLinkLevels := srcHost.rack.dataCenter.topo.matchLink(srcHost, dstHost)
+	if link != nil {
+		srcLevels, dstLevels = srcLinkLevels, dstLinkLevels
+		ps.down = link.Down
+		ps.addDelay(link.Latency, link.Jitter, link.Distribution)
+		ps.addBandwidth(link.Bandwidth, "link:"+from+"->"+to)
+		ps.addRates(link.LossRate, link.DupRate)
+	}
+	ps.climb(srcPath, srcLevels, "/out")
+	ps.climb(dstPath, dstLevels, "/in")
+	state.OK = !ps.down
+	state.Latency = ps.latency
+	state.Jitter = ps.jitter
+	state.Distribution = ps.distribution
+	state.Uplinks = ps.uplinks
+	state.LossRate = 1 - ps.deliveryRate
+	state.DupRate = 1 - ps.singleRate
+	return
+}
+
+//the accumulated state of the nodes along the path.
+type pathState struct {
+	down         bool
+	latency      time.Duration
+	jitter       time.Duration
+	maxJitter    time.Duration
+	distribution string //the distribution of the node contributes the most jitter.
+	uplinks      []Uplink
+	deliveryRate float64 //the probability of a packet going through all the nodes.
+	singleRate   float64 //the probability of a datagram not duplicated by any node.
+}
+
+//accumulate the state of the first 'levels' nodes of the path, the host's internal network is always involved.
+//'direction' tells whether the data goes out of or into the nodes, each direction of an uplink has its own bandwidth.
+func (ps *pathState) climb(path []node, levels int, direction string) {
+	ps.down = ps.down || path[0].state().InternalDown
+	for i := 0; i < levels; i++ {
+		state := path[i].state()
+		ps.down = ps.down || state.ExternalDown
+		ps.addDelay(state.Latency, state.Jitter, state.Distribution)
+		ps.addBandwidth(state.Bandwidth, path[i].fullName()+direction)
+		ps.addRates(state.LossRate, state.DupRate)
+		if i+1 < len(path) {
+			ps.down = ps.down || path[i+1].state().InternalDown
+		}
+	}
+}
+
+func (ps *pathState) addRates(lossRate, dupRate float64) {
+	ps.deliveryRate *= 1 - lossRate
+	ps.singleRate *= 1 - dupRate
+}
+
+//zero bandwidth means unlimited.
+func (ps *pathState) addBandwidth(bandwidth int64, uplink string) {
+	if bandwidth > 0 {
+		ps.uplinks = append(ps.uplinks, Uplink{Name: uplink, Bandwidth: bandwidth})
+	}
+}
+
+func (ps *pathState) addDelay(latency, jitter time.Duration, distribution string) {
+	ps.latency += latency
+	ps.jitter += jitter
+	if jitter > ps.maxJitter {
+		ps.maxJitter = jitter
+		ps.distribution = distribution
+	}
+}
+
+//find the most specific link for the data flowing from source host to destination host,
+//the ends of the link in the direction of the data, and the number of nodes below each end.
+func (topo *topology) matchLink(srcHost, dstHost *host) (link *Link, from, to string, srcLevels, dstLevels int) {
+	srcName := srcHost.fullName()
+	dstName := dstHost.fullName()
+	maxDepth := 0
+	for _, l := range topo.links {
+		lFrom, lTo := l.From, l.To
+		if !containsNode(lFrom, srcName) || !containsNode(lTo, dstName) {
+			if l.OneWay {
+				continue
+			}
+			lFrom, lTo = lTo, lFrom
+			if !containsNode(lFrom, srcName) || !containsNode(lTo, dstName) {
+				continue
 			}
 		}
+		depth := nodeDepth(lFrom) + nodeDepth(lTo)
+		if depth > maxDepth || depth == maxDepth && preferLink(l, link) {
+			maxDepth = depth
+			link, from, to = l, lFrom, lTo
+			srcLevels = nodeDepth(srcName) - nodeDepth(from)
+			dstLevels = nodeDepth(dstName) - nodeDepth(to)
+		}
+	}
+	return
+}
+
+//break the tie of two links with the same depth, the one with the deeper end wins, then the one with the smaller key,
+//so the same link is matched in both directions regardless of the map order.
+func preferLink(l, current *Link) bool {
+	lDepth := nodeDepth(l.From)
+	if d := nodeDepth(l.To); d > lDepth {
+		lDepth = d
+	}
+	currentDepth := nodeDepth(current.From)
+	if d := nodeDepth(current.To); d > currentDepth {
+		currentDepth = d
+	}
+	if lDepth != currentDepth {
+		return lDepth > currentDepth
+	}
+	lKey, currentKey := newLinkKey(l.From, l.To), newLinkKey(current.From, current.To)
+	if lKey.a != currentKey.a {
+		return lKey.a < currentKey.a
+	}
+	return lKey.b < currentKey.b
+}
+
+//the number of levels of the node name, 1 for data center, 2 for rack and 3 for host.
+func nodeDepth(name string) int {
+	return strings.Count(name, ".") + 1
+}
+
+//check if the node named 'name' is 'parent' or under 'parent'.
+func containsNode(parent, name string) bool {
+	return name == parent || strings.HasPrefix(name, parent+".")
+}
+
+//add or update the link between two nodes.
+func (topo *topology) setLink(link Link) (err error) {
+	topo.mutex.Lock()
+	defer topo.mutex.Unlock()
+	err = topo.putLink(&link)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	evLink := link
+	topo.events.publish(Event{Type: EventLinkSet, Link: &evLink})
+	topo.notifyUpdate()
+	return
+}
+
+func (topo *topology) putLink(link *Link) (err error) {
+	if !validDistribution(link.Distribution) {
+		err = errors.New("unknown distribution " + link.Distribution)
+		return
+	}
+	if !validRate(link.LossRate) || !validRate(link.DupRate) {
+		err = errors.New("loss rate and dup rate should be between 0 and 1")
+		return
+	}
+	if containsNode(link.From, link.To) || containsNode(link.To, link.From) {
+		err = errors.New("link can not be set between a node and its descendant")
+		return
+	}
+	if _, err = topo.lookup(link.From); err != nil {
+		return
 	}
-	down := clientSideDown || serverSideDown
-	ok = !down
+	if _, err = topo.lookup(link.To); err != nil {
+		return
+	}
+	topo.links[newLinkKey(link.From, link.To)] = link
+	return
+}
+
+func (topo *topology) removeLink(from, to string) (err error) {
+	topo.mutex.Lock()
+	defer topo.mutex.Unlock()
+	key := newLinkKey(from, to)
+	if topo.links[key] == nil {
+		err = errors.New("link undefined")
+		log.Println(err)
+		return
+	}
+	delete(topo.links, key)
+	topo.events.publish(Event{Type: EventLinkRemoved, Link: &Link{From: from, To: to}})
+	topo.notifyUpdate()
+	return
+}
+
+func (topo *topology) link(from, to string) (link Link, err error) {
+	topo.mutex.RLock()
+	defer topo.mutex.RUnlock()
+	l := topo.links[newLinkKey(from, to)]
+	if l == nil {
+		err = errors.New("link undefined")
+		log.Println(err)
+		return
+	}
+	link = *l
+	return
+}
+
+func (topo *topology) allLinks() (links []Link) {
+	topo.mutex.RLock()
+	defer topo.mutex.RUnlock()
+	for _, l := range topo.sortedLinks() {
+		links = append(links, *l)
+	}
+	return
+}
+
+func (topo *topology) sortedLinks() (links []*Link) {
+	for _, l := range topo.links {
+		links = append(links, l)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		ki, kj := newLinkKey(links[i].From, links[i].To), newLinkKey(links[j].From, links[j].To)
+		return ki.a < kj.a || ki.a == kj.a && ki.b < kj.b
+	})
 	return
 }
 
@@ -395,7 +836,11 @@ func newTopology(configReader io.Reader) (topo *topology, err error) {
 	topo = new(topology)
 	topo.ports = make(map[int]*host)
 	topo.dataCenterMap = make(map[string]*dataCenter)
+	topo.links = make(map[linkKey]*Link)
+	topo.snapshots = make(map[string]*snapshot)
+	topo.conns = make(map[int]*ConnInfo)
 	topo.updateCh = make(chan struct{})
+	topo.defaults = [3]*NodeState{config.DcDefault, config.RackDefault, config.HostDefault}
 	for _, confDC := range config.DataCenters {
 		if confDC.RackDefault == nil {
 			confDC.RackDefault = config.RackDefault
@@ -409,9 +854,84 @@ func newTopology(configReader io.Reader) (topo *topology, err error) {
 		dc := newDc(confDC, topo)
 		topo.dataCenterMap[dc.name] = dc
 	}
+	for _, link := range config.Links {
+		err = topo.putLink(link)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	return
+}
+
+//Serialize the live topology back into a config, the node states include the runtime changes.
+//Only server ports are exported, client ports are registered again when the clients reconnect.
+//Nodes are sorted by name so the output is stable.
+func (topo *topology) config() (config *Config) {
+	topo.mutex.RLock()
+	defer topo.mutex.RUnlock()
+	config = new(Config)
+	config.DcDefault, config.RackDefault, config.HostDefault = topo.defaults[0], topo.defaults[1], topo.defaults[2]
+	config.DataCenters = []*DataCenter{}
+	for _, dc := range topo.dataCenterMap {
+		dcState := dc.NodeState
+		confDC := &DataCenter{Name: dc.name, NodeState: &dcState, Racks: []*Rack{}}
+		for _, rack := range dc.rackMap {
+			rackState := rack.NodeState
+			confRack := &Rack{Name: rack.name, NodeState: &rackState, Hosts: []*Host{}}
+			for _, host := range rack.hostMap {
+				hostState := host.NodeState
+				confHost := &Host{Name: host.name, NodeState: &hostState, Ports: []int{}}
+				for port, portType := range host.portMap {
+					if portType == serverPortType {
+						confHost.Ports = append(confHost.Ports, port)
+					}
+				}
+				sort.Ints(confHost.Ports)
+				confRack.Hosts = append(confRack.Hosts, confHost)
+			}
+			sort.Slice(confRack.Hosts, func(i, j int) bool { return confRack.Hosts[i].Name < confRack.Hosts[j].Name })
+			confDC.Racks = append(confDC.Racks, confRack)
+		}
+		sort.Slice(confDC.Racks, func(i, j int) bool { return confDC.Racks[i].Name < confDC.Racks[j].Name })
+		config.DataCenters = append(config.DataCenters, confDC)
+	}
+	sort.Slice(config.DataCenters, func(i, j int) bool { return config.DataCenters[i].Name < config.DataCenters[j].Name })
+	config.Links = []*Link{}
+	for _, l := range topo.sortedLinks() {
+		link := *l
+		config.Links = append(config.Links, &link)
+	}
 	return
 }
 
+//move the registered ports and snapshots of the old topology to the hosts with the same names,
+//ports on hosts not in the new topology are dropped.
+func (topo *topology) mergePorts(old *topology) {
+	old.mutex.RLock()
+	defer old.mutex.RUnlock()
+	for port, oldHost := range old.ports {
+		//a stopped server port is left in 'ports'.
+		portType, ok := oldHost.portMap[port]
+		if !ok {
+			continue
+		}
+		nod, err := topo.lookup(oldHost.fullName())
+		if err != nil {
+			continue
+		}
+		newHost := nod.(*host)
+		newHost.portMap[port] = portType
+		topo.ports[port] = newHost
+		if info := old.conns[port]; info != nil {
+			topo.conns[port] = info
+		}
+	}
+	for name, snap := range old.snapshots {
+		topo.snapshots[name] = snap
+	}
+}
+
 func (topo *topology) lookup(fullName string) (nod node, err error) {
 	parts := strings.Split(fullName, ".")
 	dc := topo.dataCenterMap[parts[0]]
@@ -465,6 +985,10 @@ func (topo *topology) getUpdateChannel() (updateCh chan struct{}) {
 	return
 }
 
+func validRate(rate float64) bool {
+	return rate >= 0 && rate <= 1
+}
+
 func parsePort(port string) (portNum int, passive bool, err error) {
 	portNum, err = strconv.Atoi(port)
 	if err != nil {
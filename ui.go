@@ -0,0 +1,217 @@
+package stadis
+
+//The dashboard served at '/ui', it shows the topology, the proxies and the live connections of a namespace,
+//and updates the node states through '/nodeState'. It reloads on the events from '/events'.
+var dashboardHTML = []byte(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>stadis</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 20px; }
+h2 { font-size: 16px; margin-top: 24px; }
+ul { list-style: none; padding-left: 20px; margin: 0; }
+li { margin: 2px 0; }
+.node { cursor: pointer; padding: 1px 4px; border-radius: 3px; }
+.node:hover, .selected { background: #def; }
+.down { color: #c00; font-weight: bold; }
+.ports { color: #666; }
+button { margin-left: 4px; font-size: 12px; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+#editor { position: fixed; top: 20px; right: 20px; border: 1px solid #ccc; padding: 12px; background: #fff; display: none; }
+#error { color: #c00; }
+</style>
+</head>
+<body>
+<div id="error"></div>
+<h2>Topology</h2>
+<div id="tree"></div>
+<h2>Proxies</h2>
+<div id="proxies"></div>
+<h2>Connections</h2>
+<div id="conns"></div>
+<div id="editor">
+<b id="editName"></b><br><br>
+Latency (ms) <input id="editLatency" size="8"><br>
+<label><input type="checkbox" id="editInternal"> InternalDown</label><br>
+<label><input type="checkbox" id="editExternal"> ExternalDown</label><br><br>
+<button onclick="saveNode()">Save</button><button onclick="closeEditor()">Close</button>
+</div>
+<script>
+var namespace = new URLSearchParams(location.search).get("namespace") || "";
+var editing = null;
+
+function api(path) {
+	var sep = path.indexOf("?") < 0 ? "?" : "&";
+	return path + sep + "namespace=" + encodeURIComponent(namespace);
+}
+
+function request(method, path, body) {
+	return fetch(api(path), {method: method, body: body}).then(function(resp) {
+		if (!resp.ok) {
+			return resp.text().then(function(text) { throw new Error(text); });
+		}
+		return resp.text();
+	}).then(function(text) {
+		document.getElementById("error").textContent = "";
+		return text ? JSON.parse(text) : null;
+	}).catch(function(err) {
+		document.getElementById("error").textContent = err.message;
+		throw err;
+	});
+}
+
+function el(tag, text, cls) {
+	var e = document.createElement(tag);
+	if (text !== undefined) {
+		e.textContent = text;
+	}
+	if (cls) {
+		e.className = cls;
+	}
+	return e;
+}
+
+function ms(ns) {
+	return ns / 1000000 + "ms";
+}
+
+function toggle(name, field) {
+	request("GET", "/nodeState?name=" + encodeURIComponent(name)).then(function(state) {
+		state[field] = !state[field];
+		return request("POST", "/nodeState?name=" + encodeURIComponent(name), JSON.stringify(state));
+	}).then(load);
+}
+
+function nodeItem(name, shortName, state, ports) {
+	var li = el("li");
+	var label = el("span", shortName + " " + ms(state.Latency), "node" + (name == editing ? " selected" : ""));
+	label.onclick = function() { openEditor(name); };
+	li.appendChild(label);
+	if (state.InternalDown) {
+		li.appendChild(el("span", " internal-down", "down"));
+	}
+	if (state.ExternalDown) {
+		li.appendChild(el("span", " external-down", "down"));
+	}
+	if (ports && ports.length) {
+		li.appendChild(el("span", " ports: " + ports.join(", "), "ports"));
+	}
+	["InternalDown", "ExternalDown"].forEach(function(field) {
+		var b = el("button", (state[field] ? "up " : "down ") + field.replace("Down", "").toLowerCase());
+		b.onclick = function() { toggle(name, field); };
+		li.appendChild(b);
+	});
+	return li;
+}
+
+function renderTree(config) {
+	var root = el("ul");
+	config.DataCenters.forEach(function(dc) {
+		var dcItem = nodeItem(dc.Name, dc.Name, dc);
+		var racks = el("ul");
+		dc.Racks.forEach(function(rack) {
+			var rackName = dc.Name + "." + rack.Name;
+			var rackItem = nodeItem(rackName, rack.Name, rack);
+			var hosts = el("ul");
+			rack.Hosts.forEach(function(host) {
+				hosts.appendChild(nodeItem(rackName + "." + host.Name, host.Name, host, host.Ports));
+			});
+			rackItem.appendChild(hosts);
+			racks.appendChild(rackItem);
+		});
+		dcItem.appendChild(racks);
+		root.appendChild(dcItem);
+	});
+	var tree = document.getElementById("tree");
+	tree.innerHTML = "";
+	tree.appendChild(root);
+}
+
+function renderTable(id, headers, rows) {
+	var div = document.getElementById(id);
+	div.innerHTML = "";
+	if (!rows.length) {
+		div.textContent = "none";
+		return;
+	}
+	var table = el("table");
+	var tr = el("tr");
+	headers.forEach(function(h) { tr.appendChild(el("th", h)); });
+	table.appendChild(tr);
+	rows.forEach(function(row) {
+		var tr = el("tr");
+		row.forEach(function(cell) { tr.appendChild(el("td", String(cell))); });
+		table.appendChild(tr);
+	});
+	div.appendChild(table);
+}
+
+function flow(state) {
+	return state.OK ? ms(state.Latency) : "down";
+}
+
+function loadConns() {
+	request("GET", "/connections").then(function(conns) {
+		renderTable("conns", ["client", "server", "sent", "recv", "send", "recv"], conns.map(function(c) {
+			return [c.ClientHost + ":" + c.ClientPort, c.ServerHost + ":" + c.ServerPort,
+				c.SentBytes + "B", c.RecvBytes + "B", flow(c.State.Send), flow(c.State.Recv)];
+		}));
+	});
+}
+
+function load() {
+	request("GET", "/config").then(function(config) {
+		renderTree(config);
+		renderTable("proxies", ["port", "proxy", "client", "origin"], (config.Proxies || []).map(function(p) {
+			return [p.ProxyPort, p.ProxyName, p.ClientName, p.OriginAddr];
+		}));
+	});
+	loadConns();
+}
+
+function openEditor(name) {
+	request("GET", "/nodeState?name=" + encodeURIComponent(name)).then(function(state) {
+		editing = name;
+		document.getElementById("editName").textContent = name;
+		document.getElementById("editLatency").value = state.Latency / 1000000;
+		document.getElementById("editInternal").checked = state.InternalDown;
+		document.getElementById("editExternal").checked = state.ExternalDown;
+		document.getElementById("editor").style.display = "block";
+		load();
+	});
+}
+
+function closeEditor() {
+	editing = null;
+	document.getElementById("editor").style.display = "none";
+	load();
+}
+
+function saveNode() {
+	var name = editing;
+	request("GET", "/nodeState?name=" + encodeURIComponent(name)).then(function(state) {
+		state.Latency = Math.round(parseFloat(document.getElementById("editLatency").value) * 1000000);
+		state.InternalDown = document.getElementById("editInternal").checked;
+		state.ExternalDown = document.getElementById("editExternal").checked;
+		return request("POST", "/nodeState?name=" + encodeURIComponent(name), JSON.stringify(state));
+	}).then(load);
+}
+
+//the events are named by their types, a listener is needed for each of them.
+var events = new EventSource(api("/events"));
+["nodeState", "nodeAdded", "nodeRemoved", "serverStarted", "serverStopped", "linkSet", "linkRemoved",
+	"config", "restore", "proxyStarted", "proxyStopped", "proxyUpdated"].forEach(function(type) {
+	events.addEventListener(type, load);
+});
+["clientConnected", "clientDisconnected"].forEach(function(type) {
+	events.addEventListener(type, loadConns);
+});
+load();
+//the bytes of the connections are reported every second.
+setInterval(loadConns, 2000);
+</script>
+</body>
+</html>
+`)
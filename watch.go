@@ -0,0 +1,181 @@
+package stadis
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//How long to wait before reconnecting the watch stream after it is broken.
+const watchRetryDelay = 100 * time.Millisecond
+
+//the bytes are reported with the ports, so the API server can list them.
+type connPorts struct {
+	ClientPort string
+	ServerPort string
+	SentBytes  int64 `json:",omitempty"`
+	RecvBytes  int64 `json:",omitempty"`
+}
+
+type connStateResult struct {
+	State *ConnState `json:",omitempty"`
+	Err   string     `json:",omitempty"`
+	Kill  string     `json:",omitempty"` //the connection is killed through the API.
+}
+
+//connWatcher keeps one watch stream to the backend for all the connections of a process,
+//when the topology is changed, it fetches the states of all the connections in one batch
+//and fans them out to the connections, the cached states of the packet connections are invalidated.
+type connWatcher struct {
+	backend     Backend
+	mu          sync.Mutex
+	conns       map[*connection]bool
+	packetConns map[*packetConn]bool
+	cancel      context.CancelFunc //nil if the watch loop is not running.
+
+	//the watch loop and the report loop refresh one at a time, so a batch fetched before
+	//a topology change never overwrites the states fetched after it.
+	refreshMu sync.Mutex
+}
+
+func newConnWatcher(backend Backend) *connWatcher {
+	return &connWatcher{backend: backend, conns: make(map[*connection]bool), packetConns: make(map[*packetConn]bool)}
+}
+
+//the watch loop starts with the first connection.
+func (w *connWatcher) add(c *connection) {
+	w.mu.Lock()
+	w.conns[c] = true
+	w.start()
+	w.mu.Unlock()
+}
+
+//the watch loop stops with the last connection.
+func (w *connWatcher) remove(c *connection) {
+	w.mu.Lock()
+	delete(w.conns, c)
+	w.stop()
+	w.mu.Unlock()
+}
+
+func (w *connWatcher) addPacketConn(pc *packetConn) {
+	w.mu.Lock()
+	w.packetConns[pc] = true
+	w.start()
+	w.mu.Unlock()
+}
+
+func (w *connWatcher) removePacketConn(pc *packetConn) {
+	w.mu.Lock()
+	delete(w.packetConns, pc)
+	w.stop()
+	w.mu.Unlock()
+}
+
+//must be called with the mutex held.
+func (w *connWatcher) start() {
+	if w.cancel == nil {
+		var ctx context.Context
+		ctx, w.cancel = context.WithCancel(context.Background())
+		go w.loop(ctx)
+		go w.reportLoop(ctx)
+	}
+}
+
+//must be called with the mutex held.
+func (w *connWatcher) stop() {
+	if len(w.conns) == 0 && len(w.packetConns) == 0 && w.cancel != nil {
+		w.cancel()
+		w.cancel = nil
+	}
+}
+
+func (w *connWatcher) loop(ctx context.Context) {
+	for {
+		err := w.backend.watchChanges(ctx, w.changed)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println(err)
+		//the connections fail if their states can't be fetched either.
+		w.changed()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryDelay):
+		}
+	}
+}
+
+//refresh periodically, so the bytes of the connections are reported.
+func (w *connWatcher) reportLoop(ctx context.Context) {
+	ticker := time.NewTicker(connReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.refresh()
+		}
+	}
+}
+
+//the topology is changed, or the changes may be missed.
+func (w *connWatcher) changed() {
+	w.mu.Lock()
+	for pc := range w.packetConns {
+		pc.invalidate()
+	}
+	w.mu.Unlock()
+	w.refresh()
+}
+
+//fetch the states of all the connections and deliver them.
+func (w *connWatcher) refresh() {
+	w.refreshMu.Lock()
+	defer w.refreshMu.Unlock()
+	w.mu.Lock()
+	conns := make([]*connection, 0, len(w.conns))
+	for c := range w.conns {
+		conns = append(conns, c)
+	}
+	w.mu.Unlock()
+	if len(conns) == 0 {
+		return
+	}
+	ports := make([]connPorts, len(conns))
+	for i, c := range conns {
+		ports[i] = connPorts{
+			ClientPort: c.clientPort,
+			ServerPort: c.serverPort,
+			SentBytes:  atomic.LoadInt64(&c.sentBytes),
+			RecvBytes:  atomic.LoadInt64(&c.recvBytes),
+		}
+	}
+	results, err := w.backend.connStates(ports)
+	if err == nil && len(results) != len(conns) {
+		err = errors.New("connStates: unexpected number of results")
+	}
+	for i, c := range conns {
+		if err == nil && results[i].Kill != "" {
+			c.kill(results[i].Kill)
+			w.remove(c)
+			continue
+		}
+		if err == nil && results[i].Err == "" {
+			c.setState(results[i].State)
+			continue
+		}
+		connErr := err
+		if connErr == nil {
+			connErr = errors.New(results[i].Err)
+		}
+		log.Println(connErr)
+		c.fail(connErr)
+		w.remove(c)
+	}
+}